@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/phuslu/glog"
+	"github.com/valyala/fasthttp"
+)
+
+type AppDetails struct {
+	PackageName   string  `json:"pkg_name"`
+	Title         string  `json:"title,omitempty"`
+	Developer     string  `json:"developer,omitempty"`
+	Category      string  `json:"category,omitempty"`
+	Rating        float64 `json:"rating,omitempty"`
+	Installs      string  `json:"installs,omitempty"`
+	Updated       string  `json:"updated,omitempty"`
+	ContentRating string  `json:"content_rating,omitempty"`
+	Icon          string  `json:"icon,omitempty"`
+}
+
+// SetField sets the field by its extraction name, e.g. the details_regex key.
+func (d *AppDetails) SetField(name, value string) bool {
+	value = strings.TrimSpace(value)
+	switch name {
+	case "title":
+		d.Title = value
+	case "developer":
+		d.Developer = value
+	case "category":
+		d.Category = value
+	case "rating":
+		d.Rating, _ = strconv.ParseFloat(strings.Replace(value, ",", ".", 1), 64)
+	case "installs":
+		d.Installs = value
+	case "updated":
+		d.Updated = value
+	case "content_rating":
+		d.ContentRating = value
+	case "icon":
+		d.Icon = value
+	default:
+		return false
+	}
+	return true
+}
+
+type AppResponse struct {
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+	GEO    string `json:"geo,omitempty"`
+	AppDetails
+}
+
+func (r AppResponse) Table() ([]string, [][]string) {
+	rating := ""
+	if r.Rating > 0 {
+		rating = strconv.FormatFloat(r.Rating, 'f', 1, 64)
+	}
+	return []string{"status", "error", "geo", "pkg_name", "title", "developer", "category", "rating", "installs", "updated", "content_rating", "icon"},
+		[][]string{{strconv.Itoa(r.Status), r.Error, r.GEO, r.PackageName, r.Title, r.Developer, r.Category, rating, r.Installs, r.Updated, r.ContentRating, r.Icon}}
+}
+
+func (h *LookupHandler) App(ctx *fasthttp.RequestCtx) {
+	if glog.V(2) {
+		glog.Infof("%s \"%s %s\" \"%s\"", ctx.RemoteAddr(), ctx.Method(), ctx.URI(), ctx.UserAgent())
+	}
+
+	pkgName, _ := ctx.UserValue("pkgname").(string)
+	geo := string(ctx.QueryArgs().Peek("geo"))
+
+	// the package name goes into the upstream url and the cache key
+	if !pkgNameRegex.MatchString(pkgName) {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		Render(ctx, AppResponse{
+			Status: 400,
+			Error:  fmt.Sprintf("invalid package name %#v", pkgName),
+			GEO:    geo,
+		})
+		return
+	}
+
+	country, lang, err := ParseCountry(geo)
+	if err != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		Render(ctx, AppResponse{
+			Status: 400,
+			Error:  err.Error(),
+			GEO:    geo,
+		})
+		return
+	}
+
+	details, err := h.googleplayDetails(pkgName, country, lang)
+	if err != nil {
+		Render(ctx, AppResponse{
+			Status: SetErrorStatus(ctx, err),
+			Error:  err.Error(),
+			GEO:    geo,
+		})
+		return
+	}
+
+	Render(ctx, AppResponse{
+		Status:     200,
+		GEO:        country,
+		AppDetails: *details,
+	})
+}
+
+func (h *LookupHandler) googleplayDetails(pkgName, country, lang string) (*AppDetails, error) {
+	key := "details:" + pkgName + ":" + country
+	if v, ok := h.SearchCache.GetNotStale(key); ok {
+		if details, ok := v.(*AppDetails); ok {
+			return details, nil
+		}
+	}
+
+	v, err, _ := h.Singleflight.Do(key, func() (interface{}, error) {
+		return h.details(key, pkgName, country, lang)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	details, ok := v.(*AppDetails)
+	if !ok {
+		return nil, fmt.Errorf("unexpected details %T of %#v", v, key)
+	}
+
+	return details, nil
+}
+
+// details parses the schema.org json-ld metadata of the details page, then
+// fills or overrides the fields matched by DetailsSelector and DetailsRegex.
+func (h *LookupHandler) details(key, pkgName, country, lang string) (*AppDetails, error) {
+	data, err := h.fetch(ExpandURL(h.DetailsURL, pkgName, country, lang), country, lang, h.detailsDone)
+	if err != nil {
+		return nil, err
+	}
+
+	details := &AppDetails{PackageName: pkgName}
+
+	for _, match := range jsonldRegex.FindAllStringSubmatch(data, -1) {
+		var ld struct {
+			Type          string `json:"@type"`
+			Name          string `json:"name"`
+			Image         string `json:"image"`
+			Category      string `json:"applicationCategory"`
+			ContentRating string `json:"contentRating"`
+			Author        struct {
+				Name string `json:"name"`
+			} `json:"author"`
+			AggregateRating struct {
+				RatingValue interface{} `json:"ratingValue"`
+			} `json:"aggregateRating"`
+		}
+
+		if json.Unmarshal([]byte(match[1]), &ld) != nil || ld.Type != "SoftwareApplication" {
+			continue
+		}
+
+		details.SetField("title", ld.Name)
+		details.SetField("developer", ld.Author.Name)
+		details.SetField("category", ld.Category)
+		details.SetField("rating", fmt.Sprint(ld.AggregateRating.RatingValue))
+		details.SetField("content_rating", ld.ContentRating)
+		details.SetField("icon", ld.Image)
+		break
+	}
+
+	if h.DetailsSelector != nil {
+		if records, _ := h.DetailsSelector.Extract(data); len(records) > 0 {
+			for name, value := range records[0] {
+				details.SetField(name, value)
+			}
+		}
+	}
+
+	for name, regex := range h.DetailsRegex {
+		if match := regex.FindStringSubmatch(data); len(match) > 1 {
+			details.SetField(name, match[1])
+		}
+	}
+
+	if details.Title == "" {
+		return nil, fmt.Errorf("empty")
+	}
+
+	glog.Infof("googleplayDetails(%#v, %#v) return %+v", pkgName, country, details)
+
+	h.SearchCache.Set(key, details, time.Now().Add(h.SearchTTL))
+
+	return details, nil
+}
+
+// detailsDone makes the check of a details page, it is done once the page
+// read so far has the SoftwareApplication json-ld metadata and every
+// DetailsRegex match, the selectors need the whole page.
+func (h *LookupHandler) detailsDone() DoneFunc {
+	if h.DetailsSelector != nil {
+		return nil
+	}
+
+	jsonld := &CompleteMatcher{Regex: jsonldRegex}
+	var app bool
+
+	matchers := make([]*CompleteMatcher, 0, len(h.DetailsRegex))
+	for _, regex := range h.DetailsRegex {
+		matchers = append(matchers, &CompleteMatcher{Regex: regex})
+	}
+
+	return func(data string) bool {
+		// a page may have other json-ld blocks before the one of the app
+		for !app {
+			loc := jsonld.Next(data)
+			if loc == nil {
+				return false
+			}
+
+			var ld struct {
+				Type string `json:"@type"`
+			}
+			app = json.Unmarshal([]byte(data[loc[2]:loc[3]]), &ld) == nil && ld.Type == "SoftwareApplication"
+		}
+
+		for len(matchers) > 0 {
+			if matchers[0].Next(data) == nil {
+				return false
+			}
+			matchers = matchers[1:]
+		}
+
+		return true
+	}
+}
+
+var pkgNameRegex = regexp.MustCompile(`^[A-Za-z0-9_.]+$`)
+
+var jsonldRegex = regexp.MustCompile(`(?s)<script type="application/ld\+json"[^>]*>(.*?)</script>`)
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/golibs/lrucache"
+	"github.com/valyala/fasthttp"
+	"golang.org/x/sync/singleflight"
+)
+
+const testDetailsPage = `<html><head>
+<script type="application/ld+json">{"@type":"Organization","name":"Google"}</script>
+<script type="application/ld+json">{"@type":"SoftwareApplication","name":"%s","author":{"name":"Example Inc."}}</script>
+</head><body></body></html>`
+
+func newDetailsHandler() (*LookupHandler, *httptest.Server) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintf(w, testDetailsPage, "App "+r.URL.Query().Get("id"))
+	}))
+
+	h := &LookupHandler{
+		DetailsURL:   srv.URL + "/store/apps/details?id=%s&gl={gl}&hl={hl}",
+		SearchTTL:    time.Minute,
+		SearchCache:  lrucache.NewLRUCache(100),
+		Singleflight: &singleflight.Group{},
+		Upstream:     &Upstream{Name: "googleplay", Transport: &http.Transport{}},
+	}
+
+	return h, srv
+}
+
+func TestAppInvalidPackageName(t *testing.T) {
+	h, srv := newDetailsHandler()
+	defer srv.Close()
+
+	for _, pkgName := range []string{"", "x&gl=DE", "com.example/../x", "com.example:US"} {
+		var ctx fasthttp.RequestCtx
+		ctx.Request.SetRequestURI("/app/x?geo=US")
+		ctx.SetUserValue("pkgname", pkgName)
+
+		h.App(&ctx)
+
+		if code := ctx.Response.StatusCode(); code != fasthttp.StatusBadRequest {
+			t.Errorf("App(%#v) status %d, want 400", pkgName, code)
+		}
+	}
+}
+
+func TestGoogleplayDetailsIgnoresForeignCacheEntry(t *testing.T) {
+	h, srv := newDetailsHandler()
+	defer srv.Close()
+
+	// a value of another lookup under the details key is refetched, not a panic
+	h.SearchCache.Set("details:com.example:US", []GoogleplaySearchItem{}, time.Now().Add(time.Minute))
+
+	details, err := h.googleplayDetails("com.example", "US", "en")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if details.Title != "App com.example" || details.Developer != "Example Inc." {
+		t.Errorf("got %+v", details)
+	}
+}
+
+func TestGoogleplayDetailsEarlyStop(t *testing.T) {
+	h, srv := newDetailsHandler()
+	defer srv.Close()
+
+	// the app block comes after the organization one and a long head, the
+	// tail is larger than MaxBodySize and only fits if the read stops early
+	page := `<html><head>
+<script type="application/ld+json">{"@type":"Organization","name":"Google"}</script>` +
+		strings.Repeat("<meta name=\"x\" content=\"y\">\n", 10000) +
+		`<script type="application/ld+json">{"@type":"SoftwareApplication","name":"Example","author":{"name":"Example Inc."}}</script>
+</head><body>` + strings.Repeat("<div>x</div>\n", 100000) + `</body></html>`
+
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(page))
+	})
+	h.Upstream.MaxBodySize = 512 * 1024
+
+	details, err := h.googleplayDetails("com.example", "US", "en")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if details.Title != "Example" || details.Developer != "Example Inc." {
+		t.Errorf("got %+v", details)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudflare/golibs/lrucache"
+)
+
+const (
+	CacheFresh    = "fresh"
+	CacheStale    = "stale"
+	CacheNegative = "negative"
+)
+
+// CacheEntry is a cached lookup result. Expires is the end of its freshness,
+// the lru expiration of a positive entry is extended by the stale ttl.
+type CacheEntry struct {
+	Value    interface{}
+	Err      error
+	Negative bool
+	Expires  time.Time
+
+	revalidate int64
+}
+
+// Revalidate reports whether a stale entry should be refreshed now, at most
+// once per interval so that a broken upstream is not hammered.
+func (e *CacheEntry) Revalidate(interval time.Duration) bool {
+	now := time.Now().UnixNano()
+	next := atomic.LoadInt64(&e.revalidate)
+	if now < next {
+		return false
+	}
+	return atomic.CompareAndSwapInt64(&e.revalidate, next, now+int64(interval))
+}
+
+func CacheLoad(cache lrucache.Cache, key string) (*CacheEntry, string, bool) {
+	v, ok := cache.GetNotStale(key)
+	if !ok {
+		return nil, "", false
+	}
+
+	e, ok := v.(*CacheEntry)
+	if !ok {
+		return nil, "", false
+	}
+
+	switch {
+	case e.Negative:
+		return e, CacheNegative, true
+	case time.Now().After(e.Expires):
+		return e, CacheStale, true
+	default:
+		return e, CacheFresh, true
+	}
+}
+
+func CacheStore(cache lrucache.Cache, key string, value interface{}, ttl, staleTTL time.Duration) {
+	expires := time.Now().Add(ttl)
+	cache.Set(key, &CacheEntry{Value: value, Expires: expires}, expires.Add(staleTTL))
+}
+
+// CacheStoreNegative caches an error or a "not found" value, a zero ttl disables it.
+// A stale positive entry is kept and served instead.
+func CacheStoreNegative(cache lrucache.Cache, key string, value interface{}, err error, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+
+	if v, ok := cache.GetNotStale(key); ok {
+		if e, ok := v.(*CacheEntry); ok && !e.Negative {
+			return
+		}
+	}
+
+	expires := time.Now().Add(ttl)
+	cache.Set(key, &CacheEntry{Value: value, Err: err, Negative: true, Expires: expires}, expires)
+}
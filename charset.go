@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"unicode/utf8"
+
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/transform"
+)
+
+// htmlPeekSize is how much of a page is looked at to guess its charset.
+const htmlPeekSize = 64 * 1024
+
+// NewHTMLReader returns a reader transcoding the page r to utf-8. The charset
+// is detected from the Content-Type header, the BOM or the html <meta> tags,
+// the fallback charset is used for undeclared non utf-8 pages.
+func NewHTMLReader(r io.Reader, contentType, fallback string) io.Reader {
+	br := bufio.NewReaderSize(r, htmlPeekSize)
+	peek, _ := br.Peek(htmlPeekSize)
+
+	e, name := htmlEncoding(peek, contentType, fallback)
+	if name == "utf-8" {
+		return br
+	}
+
+	return transform.NewReader(br, e.NewDecoder())
+}
+
+// htmlEncoding determines the encoding of the page beginning with data.
+func htmlEncoding(data []byte, contentType, fallback string) (encoding.Encoding, string) {
+	e, name, certain := charset.DetermineEncoding(data, contentType)
+	if !certain && name == "windows-1252" {
+		// nothing is declared in the page
+		switch {
+		case validUTF8(data):
+			return encoding.Nop, "utf-8"
+		case fallback != "":
+			if fe, fn := charset.Lookup(fallback); fe != nil {
+				e, name = fe, fn
+			}
+		}
+	}
+
+	return e, name
+}
+
+// validUTF8 is utf8.Valid but ignores a rune cut at the end of data.
+func validUTF8(data []byte) bool {
+	for i := 0; i < utf8.UTFMax-1 && i < len(data); i++ {
+		if utf8.RuneStart(data[len(data)-1-i]) {
+			if !utf8.FullRune(data[len(data)-1-i:]) {
+				data = data[:len(data)-1-i]
+			}
+			break
+		}
+	}
+	return utf8.Valid(data)
+}
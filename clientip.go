@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+type TrustedProxies []*net.IPNet
+
+func ParseTrustedProxies(cidrs []string) (TrustedProxies, error) {
+	var tp TrustedProxies
+	for _, s := range cidrs {
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %#v: %+v", s, err)
+		}
+
+		tp = append(tp, ipnet)
+	}
+	return tp, nil
+}
+
+func (tp TrustedProxies) Contains(ip net.IP) bool {
+	for _, ipnet := range tp {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address of the client. When the peer is a trusted proxy
+// the Forwarded, X-Forwarded-For and X-Real-IP headers are consulted, and the
+// proxy chain is walked from right to left to the first untrusted hop.
+func (tp TrustedProxies) ClientIP(ctx *fasthttp.RequestCtx) string {
+	remote, _, _ := net.SplitHostPort(ctx.RemoteAddr().String())
+	if len(tp) == 0 || !tp.Contains(net.ParseIP(remote)) {
+		return remote
+	}
+
+	var hops []string
+	if v := ctx.Request.Header.Peek("Forwarded"); len(v) > 0 {
+		hops = parseForwarded(string(v))
+	} else if v := ctx.Request.Header.Peek("X-Forwarded-For"); len(v) > 0 {
+		for _, s := range strings.Split(string(v), ",") {
+			hops = append(hops, strings.TrimSpace(s))
+		}
+	} else if v := ctx.Request.Header.Peek("X-Real-IP"); len(v) > 0 {
+		hops = []string{strings.TrimSpace(string(v))}
+	}
+
+	client := remote
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(hops[i])
+		if ip == nil {
+			// unknown or obfuscated identifier
+			break
+		}
+		client = ip.String()
+		if !tp.Contains(ip) {
+			break
+		}
+	}
+
+	return client
+}
+
+// parseForwarded returns the for= addresses of a RFC 7239 Forwarded header,
+// e.g. `for=192.0.2.60;proto=http, for="[2001:db8:cafe::17]:4711"`
+func parseForwarded(s string) []string {
+	var hops []string
+	for _, element := range strings.Split(s, ",") {
+		for _, pair := range strings.Split(element, ";") {
+			pair = strings.TrimSpace(pair)
+			if len(pair) < 4 || !strings.EqualFold(pair[:4], "for=") {
+				continue
+			}
+
+			v := strings.Trim(pair[4:], `"`)
+			switch {
+			case strings.HasPrefix(v, "["):
+				if pos := strings.Index(v, "]"); pos > 0 {
+					v = v[1:pos]
+				}
+			case strings.Count(v, ":") == 1:
+				v, _, _ = net.SplitHostPort(v)
+			}
+
+			hops = append(hops, v)
+		}
+	}
+	return hops
+}
@@ -10,19 +10,58 @@ import (
 
 type Config struct {
 	Default struct {
-		ListenAddr      string
-		GracefulTimeout int
+		ListenAddr         string
+		GracefulTimeout    int
+		MaxRequestBodySize int
 	}
 	Googleplay struct {
-		SearchUrl   string
-		SearchRegex string
-		SearchTtl   int
+		SearchUrl       string
+		SearchRegex     string
+		SearchSelector  SelectorConfig
+		DetailsUrl      string
+		DetailsRegex    map[string]string
+		DetailsSelector SelectorConfig
+		Charset         string
+		Upstream        UpstreamConfig
+		SearchTtl       int
+		StaleTtl        int
+		NegativeTtl     int
+		RefreshInterval int
+		TitleThreshold  float64
+		IndexFile       string
+		IndexMaxAge     int
 	}
 	Ipinfo struct {
-		Url      string
-		Regex    string
-		CacheTtl int
+		Url              string
+		Regex            string
+		CacheTtl         int
+		StaleTtl         int
+		NegativeTtl      int
+		RefreshInterval  int
+		HealthThreshold  float64
+		HealthRetry      int
+		PrefixLen4       int
+		PrefixLen6       int
+		TrustedProxies   []string
+		BatchLimit       int
+		BatchConcurrency int
+		Providers        []IpinfoProviderConfig
 	}
+	HeaderProfiles map[string]HeaderProfileConfig
+	ProxyPools     map[string]ProxyPoolConfig
+}
+
+type IpinfoProviderConfig struct {
+	Name           string
+	Type           string
+	Url            string
+	Regex          string
+	Selector       SelectorConfig
+	Charset        string
+	Upstream       UpstreamConfig
+	Path           string
+	Lang           string
+	ReloadInterval int
 }
 
 func NewConfig(filename string) (*Config, error) {
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// countryLanguages maps every ISO 3166-1 alpha-2 country code to the default
+// google play display language (hl) of that country.
+var countryLanguages = map[string]string{
+	"AD": "ca", "AE": "ar", "AF": "fa", "AG": "en", "AI": "en", "AL": "sq",
+	"AM": "hy", "AO": "pt-PT", "AQ": "en", "AR": "es-419", "AS": "en", "AT": "de",
+	"AU": "en", "AW": "nl", "AX": "sv", "AZ": "az", "BA": "bs", "BB": "en",
+	"BD": "bn", "BE": "nl", "BF": "fr", "BG": "bg", "BH": "ar", "BI": "fr",
+	"BJ": "fr", "BL": "fr", "BM": "en", "BN": "en", "BO": "es-419", "BQ": "nl",
+	"BR": "pt-BR", "BS": "en", "BT": "en", "BV": "no", "BW": "en", "BY": "ru",
+	"BZ": "en", "CA": "en", "CC": "en", "CD": "fr", "CF": "fr", "CG": "fr",
+	"CH": "de", "CI": "fr", "CK": "en", "CL": "es-419", "CM": "fr", "CN": "zh-CN",
+	"CO": "es-419", "CR": "es-419", "CU": "es-419", "CV": "pt-PT", "CW": "nl", "CX": "en",
+	"CY": "el", "CZ": "cs", "DE": "de", "DJ": "fr", "DK": "da", "DM": "en",
+	"DO": "es-419", "DZ": "ar", "EC": "es-419", "EE": "et", "EG": "ar", "EH": "ar",
+	"ER": "en", "ES": "es", "ET": "am", "FI": "fi", "FJ": "en", "FK": "en",
+	"FM": "en", "FO": "da", "FR": "fr", "GA": "fr", "GB": "en", "GD": "en",
+	"GE": "ka", "GF": "fr", "GG": "en", "GH": "en", "GI": "en", "GL": "da",
+	"GM": "en", "GN": "fr", "GP": "fr", "GQ": "es", "GR": "el", "GS": "en",
+	"GT": "es-419", "GU": "en", "GW": "pt-PT", "GY": "en", "HK": "zh-HK", "HM": "en",
+	"HN": "es-419", "HR": "hr", "HT": "fr", "HU": "hu", "ID": "id", "IE": "en",
+	"IL": "iw", "IM": "en", "IN": "en", "IO": "en", "IQ": "ar", "IR": "fa",
+	"IS": "is", "IT": "it", "JE": "en", "JM": "en", "JO": "ar", "JP": "ja",
+	"KE": "en", "KG": "ky", "KH": "km", "KI": "en", "KM": "fr", "KN": "en",
+	"KP": "ko", "KR": "ko", "KW": "ar", "KY": "en", "KZ": "kk", "LA": "lo",
+	"LB": "ar", "LC": "en", "LI": "de", "LK": "si", "LR": "en", "LS": "en",
+	"LT": "lt", "LU": "fr", "LV": "lv", "LY": "ar", "MA": "ar", "MC": "fr",
+	"MD": "ro", "ME": "sr", "MF": "fr", "MG": "fr", "MH": "en", "MK": "mk",
+	"ML": "fr", "MM": "my", "MN": "mn", "MO": "zh-HK", "MP": "en", "MQ": "fr",
+	"MR": "ar", "MS": "en", "MT": "en", "MU": "en", "MV": "en", "MW": "en",
+	"MX": "es-419", "MY": "ms", "MZ": "pt-PT", "NA": "en", "NC": "fr", "NE": "fr",
+	"NF": "en", "NG": "en", "NI": "es-419", "NL": "nl", "NO": "no", "NP": "ne",
+	"NR": "en", "NU": "en", "NZ": "en", "OM": "ar", "PA": "es-419", "PE": "es-419",
+	"PF": "fr", "PG": "en", "PH": "en", "PK": "en", "PL": "pl", "PM": "fr",
+	"PN": "en", "PR": "es-419", "PS": "ar", "PT": "pt-PT", "PW": "en", "PY": "es-419",
+	"QA": "ar", "RE": "fr", "RO": "ro", "RS": "sr", "RU": "ru", "RW": "en",
+	"SA": "ar", "SB": "en", "SC": "en", "SD": "ar", "SE": "sv", "SG": "en",
+	"SH": "en", "SI": "sl", "SJ": "no", "SK": "sk", "SL": "en", "SM": "it",
+	"SN": "fr", "SO": "so", "SR": "nl", "SS": "en", "ST": "pt-PT", "SV": "es-419",
+	"SX": "nl", "SY": "ar", "SZ": "en", "TC": "en", "TD": "fr", "TF": "fr",
+	"TG": "fr", "TH": "th", "TJ": "tg", "TK": "en", "TL": "pt-PT", "TM": "tk",
+	"TN": "ar", "TO": "en", "TR": "tr", "TT": "en", "TV": "en", "TW": "zh-TW",
+	"TZ": "sw", "UA": "uk", "UG": "en", "UM": "en", "US": "en", "UY": "es-419",
+	"UZ": "uz", "VA": "it", "VC": "en", "VE": "es-419", "VG": "en", "VI": "en",
+	"VN": "vi", "VU": "en", "WF": "fr", "WS": "en", "YE": "ar", "YT": "fr",
+	"ZA": "en", "ZM": "en", "ZW": "en",
+}
+
+// ParseCountry validates geo as an ISO 3166-1 alpha-2 code and returns it in
+// upper case with its default language, an empty geo means no targeting.
+func ParseCountry(geo string) (country, lang string, err error) {
+	if geo == "" {
+		return "", "", nil
+	}
+
+	country = strings.ToUpper(geo)
+	lang, ok := countryLanguages[country]
+	if !ok {
+		return "", "", fmt.Errorf("invalid geo %#v, want an ISO 3166-1 alpha-2 country code", geo)
+	}
+
+	return country, lang, nil
+}
+
+// ExpandURL fills the query into %s and the country and language into the
+// {gl} and {hl} placeholders of a url template.
+func ExpandURL(template, query, country, lang string) string {
+	return strings.NewReplacer("%s", query, "{gl}", country, "{hl}", lang).Replace(template)
+}
@@ -23,6 +23,13 @@ type TCPDialer struct {
 	TLSClientSessionCache tls.ClientSessionCache
 }
 
+type connectTimeoutKey struct{}
+
+// WithConnectTimeout overrides the dialer timeout for the requests of ctx.
+func WithConnectTimeout(ctx context.Context, timeout time.Duration) context.Context {
+	return context.WithValue(ctx, connectTimeoutKey{}, timeout)
+}
+
 func (d *TCPDialer) Dial(network, address string) (net.Conn, error) {
 	return d.dialContext(context.Background(), network, address, nil)
 }
@@ -75,8 +82,13 @@ func (d *TCPDialer) dialContext(ctx context.Context, network, address string, tl
 
 	port, _ := strconv.Atoi(portStr)
 
-	if d.Timeout > 0 {
-		deadline := time.Now().Add(d.Timeout)
+	timeout := d.Timeout
+	if t, ok := ctx.Value(connectTimeoutKey{}).(time.Duration); ok && t > 0 {
+		timeout = t
+	}
+
+	if timeout > 0 {
+		deadline := time.Now().Add(timeout)
 		if d, ok := ctx.Deadline(); ok && deadline.After(d) {
 			deadline = d
 		}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// NormalizeTitle folds case, compatibility forms and diacritics, and turns
+// symbols and punctuation such as ™ ® : - into single spaces.
+func NormalizeTitle(s string) string {
+	// before NFKD which expands ™ to "TM"
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsSymbol(r) {
+			return ' '
+		}
+		return r
+	}, s)
+
+	var b strings.Builder
+	space := true
+	for _, r := range norm.NFKD.String(s) {
+		switch {
+		case unicode.Is(unicode.Mn, r):
+			continue
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			b.WriteRune(unicode.ToLower(r))
+			space = false
+		case !space:
+			b.WriteByte(' ')
+			space = true
+		}
+	}
+	return strings.TrimSpace(b.String())
+}
+
+var titleSuffixSeparators = []string{" - ", " – ", " — ", ": ", " | ", " (", " ["}
+
+// titleSuffixWords are the words a strippable suffix consists of, so that
+// "Minecraft: Education" is not taken for "Minecraft".
+var titleSuffixWords = map[string]bool{
+	"free": true, "lite": true, "pro": true, "hd": true, "premium": true, "plus": true,
+	"full": true, "paid": true, "beta": true, "demo": true, "version": true, "edition": true,
+}
+
+func isTitleSuffix(s string) bool {
+	words := strings.Fields(NormalizeTitle(s))
+	for _, word := range words {
+		if !titleSuffixWords[word] {
+			return false
+		}
+	}
+	return len(words) > 0
+}
+
+// stripTitleSuffix removes suffixes like "- Free" or "(Lite)" from a title.
+func stripTitleSuffix(s string) string {
+	for stripped := true; stripped; {
+		stripped = false
+		for _, sep := range titleSuffixSeparators {
+			if pos := strings.LastIndex(s, sep); pos > 0 && isTitleSuffix(s[pos+len(sep):]) {
+				s = s[:pos]
+				stripped = true
+			}
+		}
+	}
+	return s
+}
+
+// TitleSimilarity returns a score between 0 and 1, 1 means the normalized
+// titles are equal. A match after stripping suffixes scores lower the more
+// text was stripped.
+func TitleSimilarity(a, b string) float64 {
+	na, nb := NormalizeTitle(a), NormalizeTitle(b)
+	if na == nb {
+		return 1
+	}
+
+	score := similarity(na, nb)
+
+	sa, sb := NormalizeTitle(stripTitleSuffix(a)), NormalizeTitle(stripTitleSuffix(b))
+	if sa != na || sb != nb {
+		total := len([]rune(na)) + len([]rune(nb))
+		removed := total - len([]rune(sa)) - len([]rune(sb))
+		if s := similarity(sa, sb) * (1 - 0.2*float64(removed)/float64(total)); s > score {
+			score = s
+		}
+	}
+
+	return score
+}
+
+func similarity(a, b string) float64 {
+	ra, rb := []rune(a), []rune(b)
+	n := len(ra)
+	if len(rb) > n {
+		n = len(rb)
+	}
+	if n == 0 {
+		return 0
+	}
+	return 1 - float64(levenshtein(ra, rb))/float64(n)
+}
+
+func levenshtein(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min3(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+)
+
+// the title_threshold of development.toml
+const testTitleThreshold = 0.85
+
+func TestTitleSimilarity(t *testing.T) {
+	cases := []struct {
+		a, b  string
+		match bool
+	}{
+		{"Minecraft", "Minecraft", true},
+		{"Subway Surfers", "Subway Surfers™", true},
+		{"Pokémon GO", "Pokemon Go", true},
+		{"Minecraft", "Minecraft - Free", true},
+		{"Pou", "Pou (Lite)", true},
+		{"Nova Launcher", "Nova Launcher: Pro", true},
+		{"Asphalt 9", "Asphalt 9 - HD Edition", true},
+		{"Call of Duty: Mobile - Free", "Call of Duty: Mobile", true},
+
+		{"Call of Duty: Mobile", "Call of Duty: Warzone", false},
+		{"Minecraft", "Minecraft: Education", false},
+		{"Minecraft", "Minecraft: Story Mode", false},
+		{"Call of Duty: Mobile", "Call of Duty: Warzone - Free", false},
+		{"Clash of Clans", "Clash Royale", false},
+	}
+
+	for _, c := range cases {
+		score := TitleSimilarity(c.a, c.b)
+		if score < 0 || score > 1 {
+			t.Errorf("TitleSimilarity(%#v, %#v) = %.3f out of range", c.a, c.b, score)
+		}
+		if match := score >= testTitleThreshold; match != c.match {
+			t.Errorf("TitleSimilarity(%#v, %#v) = %.3f, match %v, want %v", c.a, c.b, score, match, c.match)
+		}
+		if reverse := TitleSimilarity(c.b, c.a); reverse != score {
+			t.Errorf("TitleSimilarity(%#v, %#v) = %.3f, not symmetric %.3f", c.b, c.a, reverse, score)
+		}
+	}
+}
+
+func TestStripTitleSuffix(t *testing.T) {
+	cases := map[string]string{
+		"Minecraft - Free":            "Minecraft",
+		"Pou (Lite)":                  "Pou",
+		"Game - Free (Ad Free)":       "Game - Free (Ad Free)",
+		"Game - Free [HD]":            "Game",
+		"Minecraft: Education":        "Minecraft: Education",
+		"Call of Duty: Mobile - Free": "Call of Duty: Mobile",
+		"Pro":                         "Pro",
+	}
+
+	for title, want := range cases {
+		if got := stripTitleSuffix(title); got != want {
+			t.Errorf("stripTitleSuffix(%#v) = %#v, want %#v", title, got, want)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// GeoProviderChain tries providers in priority order, skips the unhealthy ones
+// unless every healthy provider has failed.
+type GeoProviderChain struct {
+	Providers     []GeoProvider
+	Threshold     float64
+	RetryInterval time.Duration
+
+	health []*GeoProviderHealth
+}
+
+func NewGeoProviderChain(providers []GeoProvider, threshold float64, retry time.Duration) *GeoProviderChain {
+	c := &GeoProviderChain{
+		Providers:     providers,
+		Threshold:     threshold,
+		RetryInterval: retry,
+		health:        make([]*GeoProviderHealth, len(providers)),
+	}
+
+	for i, p := range providers {
+		c.health[i] = &GeoProviderHealth{Timeout: geoProviderTimeout(p)}
+		MetricsIpinfoProviderHealth.Store(p.Name(), c.health[i])
+	}
+
+	return c
+}
+
+func (c *GeoProviderChain) Name() string {
+	names := make([]string, len(c.Providers))
+	for i, p := range c.Providers {
+		names[i] = p.Name()
+	}
+	return strings.Join(names, ",")
+}
+
+func (c *GeoProviderChain) Lookup(ipStr string) (*IpinfoItem, error) {
+	var errs GeoChainError
+
+	tried := make([]bool, len(c.Providers))
+	for _, healthy := range []bool{true, false} {
+		for i, p := range c.Providers {
+			if tried[i] || (healthy && !c.health[i].Healthy(c.Threshold, c.RetryInterval)) {
+				continue
+			}
+			tried[i] = true
+
+			start := time.Now()
+			item, err := p.Lookup(ipStr)
+			c.health[i].Observe(time.Since(start), err)
+
+			if err != nil {
+				IncMetricsCounter(&MetricsIpinfoProviderCounter, MetricsIpinfoProviderKey{p.Name(), "error"})
+				errs.Names = append(errs.Names, p.Name())
+				errs.Errs = append(errs.Errs, err)
+				continue
+			}
+
+			IncMetricsCounter(&MetricsIpinfoProviderCounter, MetricsIpinfoProviderKey{p.Name(), "ok"})
+			return item, nil
+		}
+	}
+
+	return nil, &errs
+}
+
+// GeoChainError keeps the errors of all tried providers, it is cacheable
+// unless one of them is not, and has the status of the first classified one.
+type GeoChainError struct {
+	Names []string
+	Errs  []error
+}
+
+func (e *GeoChainError) Error() string {
+	msgs := make([]string, len(e.Errs))
+	for i, err := range e.Errs {
+		msgs[i] = e.Names[i] + ": " + err.Error()
+	}
+
+	if len(msgs) == 1 {
+		return msgs[0]
+	}
+
+	return "all providers failed: " + strings.Join(msgs, "; ")
+}
+
+func (e *GeoChainError) Cacheable() bool {
+	for _, err := range e.Errs {
+		if !Cacheable(err) {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *GeoChainError) HTTPStatus() int {
+	for _, err := range e.Errs {
+		if s, ok := err.(interface {
+			HTTPStatus() int
+		}); ok {
+			return s.HTTPStatus()
+		}
+	}
+	return fasthttp.StatusNoContent
+}
+
+const (
+	geoProviderHealthDecay = 0.2
+
+	// geoProviderLatencyWeight is the most the latency takes off the score.
+	geoProviderLatencyWeight = 0.25
+
+	// geoProviderDefaultTimeout is what the latency of a provider without an
+	// upstream timeout is measured against.
+	geoProviderDefaultTimeout = 10 * time.Second
+)
+
+// geoProviderTimeout returns the latency the health of p is measured against,
+// the request timeout of its upstream.
+func geoProviderTimeout(p GeoProvider) time.Duration {
+	if p, ok := p.(*RegexGeoProvider); ok && p.Upstream != nil && p.Upstream.Timeout > 0 {
+		return p.Upstream.Timeout
+	}
+	return geoProviderDefaultTimeout
+}
+
+// GeoProviderHealth keeps exponentially weighted moving averages of the error
+// rate and latency of recent lookups.
+type GeoProviderHealth struct {
+	Timeout time.Duration
+
+	mu        sync.Mutex
+	errors    float64
+	latency   float64
+	lastCheck time.Time
+}
+
+func (h *GeoProviderHealth) Observe(d time.Duration, err error) {
+	failed := 0.0
+	if err != nil {
+		failed = 1.0
+	}
+
+	h.mu.Lock()
+	h.errors += geoProviderHealthDecay * (failed - h.errors)
+	h.latency += geoProviderHealthDecay * (d.Seconds() - h.latency)
+	h.lastCheck = time.Now()
+	h.mu.Unlock()
+}
+
+// Score is 1 for a fast provider without errors and tends to 0 as the error
+// rate grows. The latency relative to Timeout takes off at most a quarter, so
+// that errors drive the failover and a slow provider without errors stays
+// above a threshold of 0.5.
+func (h *GeoProviderHealth) Score() float64 {
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = geoProviderDefaultTimeout
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	latency := math.Min(h.latency/timeout.Seconds(), 1)
+	return (1 - h.errors) * (1 - geoProviderLatencyWeight*latency)
+}
+
+func (h *GeoProviderHealth) Stats() (errors, latency float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.errors, h.latency
+}
+
+// Healthy reports whether the score is above threshold, an unhealthy provider
+// is still given a chance once per retry interval.
+func (h *GeoProviderHealth) Healthy(threshold float64, retry time.Duration) bool {
+	if h.Score() >= threshold {
+		return true
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if retry > 0 && time.Since(h.lastCheck) >= retry {
+		h.lastCheck = time.Now()
+		return true
+	}
+	return false
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestGeoProviderHealthScore(t *testing.T) {
+	cases := []struct {
+		name    string
+		latency time.Duration
+		failed  bool
+		healthy bool
+	}{
+		{"fast", 50 * time.Millisecond, false, true},
+		{"slow", 1200 * time.Millisecond, false, true},
+		{"timing out", 20 * time.Second, false, true},
+		{"failing", 50 * time.Millisecond, true, false},
+		{"slow and failing", 1200 * time.Millisecond, true, false},
+	}
+
+	for _, c := range cases {
+		h := &GeoProviderHealth{Timeout: 8 * time.Second}
+
+		var err error
+		if c.failed {
+			err = errors.New("failed")
+		}
+		for i := 0; i < 20; i++ {
+			h.Observe(c.latency, err)
+		}
+
+		if healthy := h.Healthy(0.5, 0); healthy != c.healthy {
+			t.Errorf("%s: score %.3f, healthy %v, want %v", c.name, h.Score(), healthy, c.healthy)
+		}
+	}
+}
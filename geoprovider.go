@@ -0,0 +1,266 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/phuslu/glog"
+	"golang.org/x/sync/singleflight"
+)
+
+type GeoProvider interface {
+	Name() string
+	Lookup(ipStr string) (*IpinfoItem, error)
+}
+
+func NewGeoProvider(c IpinfoProviderConfig, profiles map[string]*HeaderProfile, pools map[string]*ProxyPool, transport *http.Transport) (GeoProvider, error) {
+	switch c.Type {
+	case "", "regex", "html":
+		var regex *regexp.Regexp
+		if c.Regex != "" {
+			var err error
+			if regex, err = regexp.Compile(c.Regex); err != nil {
+				return nil, fmt.Errorf("regexp.Compile(%#v) error: %+v", c.Regex, err)
+			}
+		}
+		selector, err := NewSelectorExtractor(c.Selector)
+		if err != nil {
+			return nil, err
+		}
+		if regex == nil && selector == nil {
+			return nil, fmt.Errorf("geo provider %#v has neither regex nor selector", c.Name)
+		}
+		upstream, err := NewUpstream(c.Name, c.Upstream, c.Charset, profiles, pools, transport)
+		if err != nil {
+			return nil, err
+		}
+		return &RegexGeoProvider{
+			ProviderName: c.Name,
+			URL:          c.Url,
+			Regex:        regex,
+			Selector:     selector,
+			Upstream:     upstream,
+			Singleflight: &singleflight.Group{},
+		}, nil
+	case "mmdb":
+		p := &MMDBGeoProvider{
+			ProviderName:   c.Name,
+			Path:           c.Path,
+			Lang:           c.Lang,
+			ReloadInterval: time.Duration(c.ReloadInterval) * time.Second,
+		}
+		if p.ReloadInterval == 0 {
+			p.ReloadInterval = time.Minute
+		}
+		if err := p.Load(); err != nil {
+			return nil, err
+		}
+		go p.watch()
+		return p, nil
+	default:
+		return nil, fmt.Errorf("unsupported geo provider type %#v", c.Type)
+	}
+}
+
+// RegexGeoProvider scrapes a html page, the fields are extracted by Selector
+// and Regex is the fallback when the selectors match nothing.
+type RegexGeoProvider struct {
+	ProviderName string
+	URL          string
+	Regex        *regexp.Regexp
+	Selector     *SelectorExtractor
+	Upstream     *Upstream
+	Singleflight *singleflight.Group
+}
+
+func (p *RegexGeoProvider) Name() string {
+	return p.ProviderName
+}
+
+// Lookup coalesces concurrent lookups of the same ip, each caller gets its own
+// copy of the parsed item.
+func (p *RegexGeoProvider) Lookup(ipStr string) (*IpinfoItem, error) {
+	url := strings.Replace(p.URL, "%s", ipStr, 1)
+
+	v, err, _ := p.Singleflight.Do(url, func() (interface{}, error) {
+		return p.search(url, ipStr)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	item := *v.(*IpinfoItem)
+	return &item, nil
+}
+
+func (p *RegexGeoProvider) search(url, ipStr string) (*IpinfoItem, error) {
+	// a regex only provider needs no more of the page than its match
+	var newDone func() DoneFunc
+	if p.Selector == nil {
+		newDone = func() DoneFunc {
+			m := &CompleteMatcher{Regex: p.Regex}
+			return func(data string) bool {
+				return m.Next(data) != nil
+			}
+		}
+	}
+
+	data, err := p.Upstream.Get(url, "", p.Upstream.Header(""), newDone)
+	if err != nil {
+		return nil, err
+	}
+
+	item := &IpinfoItem{
+		Provider: p.ProviderName,
+	}
+
+	if !p.extractSelector(data, item) && !p.extractRegex(data, item) {
+		return nil, fmt.Errorf("empty")
+	}
+
+	glog.Infof("%s: ipinfoSearch(%#v) return %+v", p.ProviderName, ipStr, item)
+
+	return item, nil
+}
+
+func (p *RegexGeoProvider) extractSelector(data string, item *IpinfoItem) bool {
+	if p.Selector == nil {
+		return false
+	}
+
+	records, err := p.Selector.Extract(data)
+	if err != nil || len(records) == 0 {
+		return false
+	}
+
+	found := false
+	for name, value := range records[0] {
+		if item.SetField(name, value) {
+			found = true
+		}
+	}
+
+	item.Normalize()
+
+	return found
+}
+
+func (p *RegexGeoProvider) extractRegex(data string, item *IpinfoItem) bool {
+	if p.Regex == nil {
+		return false
+	}
+
+	match := p.Regex.FindStringSubmatch(data)
+	if match == nil {
+		return false
+	}
+
+	named := false
+	for i, name := range p.Regex.SubexpNames() {
+		if name != "" && item.SetField(name, match[i]) {
+			named = true
+		}
+	}
+
+	if named {
+		item.Normalize()
+	} else if len(match) >= 3 {
+		item.Location, item.ISP = match[1], match[2]
+	}
+
+	return true
+}
+
+type MMDBGeoProvider struct {
+	ProviderName   string
+	Path           string
+	Lang           string
+	ReloadInterval time.Duration
+
+	reader  atomic.Value // *MMDBReader
+	modTime time.Time
+}
+
+func (p *MMDBGeoProvider) Name() string {
+	return p.ProviderName
+}
+
+func (p *MMDBGeoProvider) Load() error {
+	fi, err := os.Stat(p.Path)
+	if err != nil {
+		return err
+	}
+
+	if fi.ModTime().Equal(p.modTime) {
+		return nil
+	}
+
+	r, err := OpenMMDB(p.Path)
+	if err != nil {
+		return fmt.Errorf("OpenMMDB(%#v) error: %+v", p.Path, err)
+	}
+
+	p.reader.Store(r)
+	p.modTime = fi.ModTime()
+
+	glog.Infof("%s: load %#v type=%s build_epoch=%d node_count=%d", p.ProviderName, p.Path, r.Metadata.DatabaseType, r.Metadata.BuildEpoch, r.Metadata.NodeCount)
+
+	return nil
+}
+
+func (p *MMDBGeoProvider) watch() {
+	for range time.Tick(p.ReloadInterval) {
+		if err := p.Load(); err != nil {
+			glog.Errorf("%s: reload %#v error: %+v", p.ProviderName, p.Path, err)
+		}
+	}
+}
+
+func (p *MMDBGeoProvider) Lookup(ipStr string) (*IpinfoItem, error) {
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid ip %#v", ipStr)
+	}
+
+	record, _, err := p.reader.Load().(*MMDBReader).Lookup(ip)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		return nil, fmt.Errorf("empty")
+	}
+
+	item := &IpinfoItem{
+		Country:  p.name(record, "country", "names"),
+		Region:   p.name(record, "subdivisions", 0, "names"),
+		City:     p.name(record, "city", "names"),
+		ASN:      MMDBString(record, "autonomous_system_number"),
+		Provider: p.ProviderName,
+	}
+	item.Normalize()
+
+	for _, key := range []string{"isp", "organization", "autonomous_system_organization"} {
+		if item.ISP = MMDBString(record, key); item.ISP != "" {
+			break
+		}
+	}
+
+	if item.Location == "" && item.ISP == "" && item.ASN == "" {
+		return nil, fmt.Errorf("empty")
+	}
+
+	return item, nil
+}
+
+func (p *MMDBGeoProvider) name(record interface{}, path ...interface{}) string {
+	if name := MMDBString(record, append(path, p.Lang)...); name != "" {
+		return name
+	}
+	return MMDBString(record, append(path, "en")...)
+}
@@ -1,11 +1,10 @@
 package main
 
 import (
-	"io/ioutil"
-	"net/http"
+	"fmt"
 	"net/url"
 	"regexp"
-	"strings"
+	"strconv"
 	"time"
 
 	"github.com/cloudflare/golibs/lrucache"
@@ -15,12 +14,22 @@ import (
 )
 
 type LookupHandler struct {
-	SearchURL    string
-	SearchRegex  *regexp.Regexp
-	SearchTTL    time.Duration
-	SearchCache  lrucache.Cache
-	Singleflight *singleflight.Group
-	Transport    *http.Transport
+	SearchURL       string
+	SearchRegex     *regexp.Regexp
+	SearchSelector  *SelectorExtractor
+	DetailsURL      string
+	DetailsRegex    map[string]*regexp.Regexp
+	DetailsSelector *SelectorExtractor
+	TitleThreshold  float64
+	SearchTTL       time.Duration
+	StaleTTL        time.Duration
+	NegativeTTL     time.Duration
+	RefreshInterval time.Duration
+	SearchCache     lrucache.Cache
+	Index           *PkgIndex
+	Singleflight    *singleflight.Group
+	Upstream        *Upstream
+	MaxBodySize     int
 }
 
 type LookupRequest struct {
@@ -30,61 +39,105 @@ type LookupRequest struct {
 }
 
 type LookupResponse struct {
-	Status      int    `json:"status"`
-	Error       string `json:"error,omitempty""`
-	PackageName string `json:"pkg_name,omitempty"`
-	Title       string `json:"title,omitempty"`
-	GEO         string `json:"geo,omitempty"`
+	Status      int     `json:"status"`
+	Error       string  `json:"error,omitempty"`
+	PackageName string  `json:"pkg_name,omitempty"`
+	Title       string  `json:"title,omitempty"`
+	GEO         string  `json:"geo,omitempty"`
+	Score       float64 `json:"score,omitempty"`
+	Cache       string  `json:"cache,omitempty"`
+}
+
+func (r LookupResponse) Table() ([]string, [][]string) {
+	score := ""
+	if r.Score > 0 {
+		score = strconv.FormatFloat(r.Score, 'f', 3, 64)
+	}
+	return []string{"status", "error", "pkg_name", "title", "geo", "score", "cache"},
+		[][]string{{strconv.Itoa(r.Status), r.Error, r.PackageName, r.Title, r.GEO, score, r.Cache}}
 }
 
 func (h *LookupHandler) Error(ctx *fasthttp.RequestCtx, err error) {
-	json.NewEncoder(ctx).Encode(LookupResponse{
+	Render(ctx, LookupResponse{
 		Status: 204,
 		Error:  err.Error(),
 	})
 }
 
+func (h *LookupHandler) BadRequest(ctx *fasthttp.RequestCtx, err error) {
+	ctx.SetStatusCode(fasthttp.StatusBadRequest)
+	Render(ctx, LookupResponse{
+		Status: 400,
+		Error:  err.Error(),
+	})
+}
+
 func (h *LookupHandler) LookupTitle(ctx *fasthttp.RequestCtx) {
 	if glog.V(2) {
 		glog.Infof("%s \"%s %s\" \"%s\"", ctx.RemoteAddr(), ctx.Method(), ctx.URI(), ctx.UserAgent())
 	}
 
+	body, err := ReadRequestBody(ctx, h.MaxBodySize)
+	if err != nil {
+		Render(ctx, LookupResponse{
+			Status: SetErrorStatus(ctx, err),
+			Error:  err.Error(),
+		})
+		return
+	}
+
 	var req LookupRequest
-	var pkgName string
 
-	err := json.Unmarshal(ctx.PostBody(), &req)
+	err = json.Unmarshal(body, &req)
 	if err != nil {
 		h.Error(ctx, err)
 		return
 	}
 
-	key := "title:" + req.Title + ":" + req.GEO
-	if v, ok := h.SearchCache.GetNotStale(key); ok {
-		pkgName = v.(string)
-	} else {
-		items, err := h.googleplaySearch(url.PathEscape(req.Title), req.GEO)
-		if err != nil {
-			h.Error(ctx, err)
-			return
-		}
+	country, lang, err := ParseCountry(req.GEO)
+	if err != nil {
+		h.BadRequest(ctx, err)
+		return
+	}
 
-		for _, item := range items {
-			if item.Title == req.Title {
-				pkgName = item.PackageName
-				h.SearchCache.Set(key, pkgName, time.Now().Add(h.SearchTTL))
-				break
+	key := "title:" + req.Title + ":" + country
+	item, status, err := h.lookup(key, func() (*GoogleplaySearchItem, error) {
+		if h.Index != nil {
+			if item := h.matchTitle(req.Title, h.Index.LookupTitle(country, req.Title)); item != nil {
+				return item, nil
 			}
 		}
+
+		items, err := h.googleplaySearch(url.PathEscape(req.Title), country, lang)
+		if err != nil {
+			return nil, err
+		}
+
+		return h.matchTitle(req.Title, items), nil
+	})
+	if err != nil {
+		Render(ctx, LookupResponse{
+			Status: SetErrorStatus(ctx, err),
+			Error:  err.Error(),
+			Cache:  status,
+		})
+		return
 	}
 
-	status := 200
-	if pkgName == "" {
-		status = 204
+	if item == nil {
+		Render(ctx, LookupResponse{
+			Status: 204,
+			Cache:  status,
+		})
+		return
 	}
 
-	json.NewEncoder(ctx).Encode(LookupResponse{
-		Status:      status,
-		PackageName: pkgName,
+	Render(ctx, LookupResponse{
+		Status:      200,
+		PackageName: item.PackageName,
+		Title:       item.Title,
+		Score:       item.Score,
+		Cache:       status,
 	})
 }
 
@@ -93,91 +146,310 @@ func (h *LookupHandler) LookupPackageName(ctx *fasthttp.RequestCtx) {
 		glog.Infof("%s \"%s %s\" \"%s\"", ctx.RemoteAddr(), ctx.Method(), ctx.URI(), ctx.UserAgent())
 	}
 
+	body, err := ReadRequestBody(ctx, h.MaxBodySize)
+	if err != nil {
+		Render(ctx, LookupResponse{
+			Status: SetErrorStatus(ctx, err),
+			Error:  err.Error(),
+		})
+		return
+	}
+
 	var req LookupRequest
-	var title string
 
-	err := json.Unmarshal(ctx.PostBody(), &req)
+	err = json.Unmarshal(body, &req)
 	if err != nil {
 		h.Error(ctx, err)
 		return
 	}
 
-	key := "pkgname:" + req.PackageName + ":" + req.GEO
-	if v, ok := h.SearchCache.GetNotStale(key); ok {
-		title = v.(string)
-	} else {
-		items, err := h.googleplaySearch(req.PackageName, req.GEO)
+	country, lang, err := ParseCountry(req.GEO)
+	if err != nil {
+		h.BadRequest(ctx, err)
+		return
+	}
+
+	key := "pkgname:" + req.PackageName + ":" + country
+	item, status, err := h.lookup(key, func() (*GoogleplaySearchItem, error) {
+		if h.Index != nil {
+			if item, ok := h.Index.LookupPackageName(country, req.PackageName); ok {
+				return item, nil
+			}
+		}
+
+		items, err := h.googleplaySearch(url.PathEscape(req.PackageName), country, lang)
 		if err != nil {
-			h.Error(ctx, err)
-			return
+			return nil, err
 		}
 
 		for _, item := range items {
 			if item.PackageName == req.PackageName {
-				title = item.Title
-				h.SearchCache.Set(key, title, time.Now().Add(h.SearchTTL))
-				break
+				return &item, nil
 			}
 		}
+
+		return nil, nil
+	})
+	if err != nil {
+		Render(ctx, LookupResponse{
+			Status: SetErrorStatus(ctx, err),
+			Error:  err.Error(),
+			Cache:  status,
+		})
+		return
+	}
+
+	if item == nil {
+		Render(ctx, LookupResponse{
+			Status: 204,
+			Cache:  status,
+		})
+		return
+	}
+
+	Render(ctx, LookupResponse{
+		Status: 200,
+		Title:  item.Title,
+		Cache:  status,
+	})
+}
+
+type SearchResult struct {
+	Position    int     `json:"position"`
+	PackageName string  `json:"pkg_name"`
+	Title       string  `json:"title"`
+	Score       float64 `json:"score"`
+}
+
+type SearchResponse struct {
+	Status  int            `json:"status"`
+	Error   string         `json:"error,omitempty"`
+	Query   string         `json:"q,omitempty"`
+	GEO     string         `json:"geo,omitempty"`
+	Results []SearchResult `json:"results"`
+}
+
+func (r SearchResponse) Table() ([]string, [][]string) {
+	rows := make([][]string, len(r.Results))
+	for i, result := range r.Results {
+		rows[i] = []string{strconv.Itoa(result.Position), result.PackageName, result.Title, strconv.FormatFloat(result.Score, 'f', 3, 64)}
+	}
+	return []string{"position", "pkg_name", "title", "score"}, rows
+}
+
+// Search returns all candidates of the search results page in their ranking
+// order, with the title similarity to the query for disambiguation.
+func (h *LookupHandler) Search(ctx *fasthttp.RequestCtx) {
+	if glog.V(2) {
+		glog.Infof("%s \"%s %s\" \"%s\"", ctx.RemoteAddr(), ctx.Method(), ctx.URI(), ctx.UserAgent())
+	}
+
+	args := ctx.QueryArgs()
+	query := string(args.Peek("q"))
+	geo := string(args.Peek("geo"))
+	limit, _ := strconv.Atoi(string(args.Peek("limit")))
+
+	if query == "" {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		Render(ctx, SearchResponse{
+			Status:  400,
+			Error:   "missing q parameter",
+			Results: []SearchResult{},
+		})
+		return
+	}
+
+	country, lang, err := ParseCountry(geo)
+	if err != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		Render(ctx, SearchResponse{
+			Status:  400,
+			Error:   err.Error(),
+			GEO:     geo,
+			Results: []SearchResult{},
+		})
+		return
+	}
+
+	items, err := h.googleplaySearch(url.PathEscape(query), country, lang)
+	if err != nil {
+		Render(ctx, SearchResponse{
+			Status:  SetErrorStatus(ctx, err),
+			Error:   err.Error(),
+			Query:   query,
+			GEO:     geo,
+			Results: []SearchResult{},
+		})
+		return
+	}
+
+	seen := make(map[string]bool, len(items))
+	results := make([]SearchResult, 0, len(items))
+	for _, item := range items {
+		if seen[item.PackageName] {
+			continue
+		}
+		seen[item.PackageName] = true
+
+		results = append(results, SearchResult{
+			Position:    len(results) + 1,
+			PackageName: item.PackageName,
+			Title:       item.Title,
+			Score:       TitleSimilarity(query, item.Title),
+		})
+	}
+
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
 	}
 
 	status := 200
-	if title == "" {
+	if len(results) == 0 {
 		status = 204
 	}
 
-	json.NewEncoder(ctx).Encode(LookupResponse{
-		Status: status,
-		Title:  title,
+	Render(ctx, SearchResponse{
+		Status:  status,
+		Query:   query,
+		GEO:     geo,
+		Results: results,
 	})
 }
 
-type GoogleplaySearchItem struct {
-	PackageName string
-	Title       string
+// matchTitle returns the candidate most similar to title, an exact match wins,
+// otherwise the best score must reach TitleThreshold.
+func (h *LookupHandler) matchTitle(title string, items []GoogleplaySearchItem) *GoogleplaySearchItem {
+	for _, item := range items {
+		if item.Title == title {
+			item.Score = 1
+			return &item
+		}
+	}
+
+	if h.TitleThreshold <= 0 {
+		return nil
+	}
+
+	var best *GoogleplaySearchItem
+	for _, item := range items {
+		item.Score = TitleSimilarity(title, item.Title)
+		if item.Score >= h.TitleThreshold && (best == nil || item.Score > best.Score) {
+			item := item
+			best = &item
+		}
+	}
+
+	return best
 }
 
-func (h *LookupHandler) googleplaySearch(query, lang string) ([]GoogleplaySearchItem, error) {
-	if v, ok := h.SearchCache.GetNotStale(query + lang); ok {
-		return v.([]GoogleplaySearchItem), nil
+// lookup returns the cached result of key, an empty result or an error of
+// search is cached for the negative ttl, a stale one is refreshed in background
+// at most once per refresh interval.
+func (h *LookupHandler) lookup(key string, search func() (*GoogleplaySearchItem, error)) (*GoogleplaySearchItem, string, error) {
+	refresh := func() (interface{}, error) {
+		item, err := search()
+		switch {
+		case err != nil:
+			if Cacheable(err) {
+				CacheStoreNegative(h.SearchCache, key, item, err, h.NegativeTTL)
+			}
+		case item == nil:
+			CacheStoreNegative(h.SearchCache, key, item, nil, h.NegativeTTL)
+		default:
+			CacheStore(h.SearchCache, key, item, h.SearchTTL, h.StaleTTL)
+		}
+		return item, err
 	}
 
-	url := strings.Replace(h.SearchURL, "%s", query, 1)
+	if e, status, ok := CacheLoad(h.SearchCache, key); ok {
+		if status == CacheStale && e.Revalidate(h.RefreshInterval) {
+			go h.Singleflight.Do(key, refresh)
+		}
+		item, _ := e.Value.(*GoogleplaySearchItem)
+		return item, status, e.Err
+	}
 
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+	v, err, _ := h.Singleflight.Do(key, refresh)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
-	req.Header.Set("Accept-Language", strings.ToLower(lang)+";q=0.9,en-US;q=0.8,en;q=0.7")
+	item, _ := v.(*GoogleplaySearchItem)
+	return item, CacheFresh, nil
+}
 
-	v, err, _ := h.Singleflight.Do(url+lang, func() (interface{}, error) {
-		return h.Transport.RoundTrip(req)
+type GoogleplaySearchItem struct {
+	PackageName string
+	Title       string
+	Score       float64
+}
+
+// googleplaySearch searches the apps of country, the search url template may
+// carry {gl} and {hl} placeholders for the country and its display language.
+// Concurrent identical searches share one fetch and the parsed items, which
+// must not be modified.
+func (h *LookupHandler) googleplaySearch(query, country, lang string) ([]GoogleplaySearchItem, error) {
+	// every kind of entry in SearchCache has its own key prefix
+	key := "search:" + query + ":" + country
+	if v, ok := h.SearchCache.GetNotStale(key); ok {
+		if items, ok := v.([]GoogleplaySearchItem); ok {
+			return items, nil
+		}
+	}
+
+	v, err, _ := h.Singleflight.Do(key, func() (interface{}, error) {
+		return h.search(key, query, country, lang)
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	resp := v.(*http.Response)
-	defer resp.Body.Close()
+	items, ok := v.([]GoogleplaySearchItem)
+	if !ok {
+		return nil, fmt.Errorf("unexpected search items %T of %#v", v, key)
+	}
 
-	data, err := ioutil.ReadAll(resp.Body)
+	return items, nil
+}
+
+func (h *LookupHandler) search(key, query, country, lang string) ([]GoogleplaySearchItem, error) {
+	// every result of the page is indexed, so it is read to the end
+	data, err := h.fetch(ExpandURL(h.SearchURL, query, country, lang), country, lang, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	matches := h.SearchRegex.FindAllStringSubmatch(string(data), -1)
-
 	items := make([]GoogleplaySearchItem, 0)
-	for _, group := range matches {
-		name, title := group[1], group[2]
-		items = append(items, GoogleplaySearchItem{name, title})
+
+	if h.SearchSelector != nil {
+		records, _ := h.SearchSelector.Extract(data)
+		for _, record := range records {
+			if record["pkg_name"] != "" && record["title"] != "" {
+				items = append(items, GoogleplaySearchItem{PackageName: record["pkg_name"], Title: record["title"]})
+			}
+		}
+	}
+
+	if len(items) == 0 && h.SearchRegex != nil {
+		for _, group := range h.SearchRegex.FindAllStringSubmatch(data, -1) {
+			name, title := group[1], group[2]
+			items = append(items, GoogleplaySearchItem{PackageName: name, Title: title})
+		}
 	}
 
-	glog.Infof("googleplaySearch(%#v, %#v) return %d items", query, lang, len(items))
+	glog.Infof("googleplaySearch(%#v, %#v) return %d items", query, country, len(items))
 
-	h.SearchCache.Set(query+lang, items, time.Now().Add(h.SearchTTL))
-	h.Singleflight.Forget(url + lang)
+	if h.Index != nil {
+		if err := h.Index.Add(country, items); err != nil {
+			glog.Errorf("PkgIndex.Add(%#v, %d items) error: %+v", country, len(items), err)
+		}
+	}
+
+	h.SearchCache.Set(key, items, time.Now().Add(h.SearchTTL))
 
 	return items, nil
 }
+
+func (h *LookupHandler) fetch(url, country, lang string, newDone func() DoneFunc) (string, error) {
+	return h.Upstream.Get(url, country, h.Upstream.Header(lang), newDone)
+}
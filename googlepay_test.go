@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/golibs/lrucache"
+	"github.com/valyala/fasthttp"
+	"golang.org/x/sync/singleflight"
+)
+
+// newGoogleplayHandler serves search pages listing one app titled by the
+// query, and details pages of any app.
+func newGoogleplayHandler() (*LookupHandler, *httptest.Server) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		switch r.URL.Path {
+		case "/store/search":
+			fmt.Fprintf(w, `<a class="title" href="/store/apps/details?id=com.example.app" title="%s">`, r.URL.Query().Get("q"))
+		default:
+			fmt.Fprintf(w, testDetailsPage, "App "+r.URL.Query().Get("id"))
+		}
+	}))
+
+	h := &LookupHandler{
+		SearchURL:    srv.URL + "/store/search?q=%s&gl={gl}&hl={hl}",
+		SearchRegex:  regexp.MustCompile(`<a class="title" href="/store/apps/details\?id=(\S+)" title="([^"]+)"`),
+		DetailsURL:   srv.URL + "/store/apps/details?id=%s&gl={gl}&hl={hl}",
+		SearchTTL:    time.Minute,
+		NegativeTTL:  time.Minute,
+		SearchCache:  lrucache.NewLRUCache(100),
+		Singleflight: &singleflight.Group{},
+		Upstream:     &Upstream{Name: "googleplay", Transport: &http.Transport{}},
+	}
+
+	return h, srv
+}
+
+func TestSearchCacheKeysDoNotCollide(t *testing.T) {
+	h, srv := newGoogleplayHandler()
+	defer srv.Close()
+
+	var ctx fasthttp.RequestCtx
+	ctx.Request.Header.SetMethod("POST")
+	ctx.Request.SetRequestURI("/lookup-title")
+	ctx.Request.SetBodyString(`{"title":"foo","geo":"IN"}`)
+	h.LookupTitle(&ctx)
+	if code := ctx.Response.StatusCode(); code != fasthttp.StatusOK {
+		t.Fatalf("lookup-title status %d: %s", code, ctx.Response.Body())
+	}
+
+	// the search "title:foo" must not read the entry of the title lookup above
+	ctx = fasthttp.RequestCtx{}
+	ctx.Request.SetRequestURI("/search?q=title:foo&geo=IN")
+	h.Search(&ctx)
+	if code := ctx.Response.StatusCode(); code != fasthttp.StatusOK {
+		t.Fatalf("search status %d: %s", code, ctx.Response.Body())
+	}
+	if body := string(ctx.Response.Body()); !strings.Contains(body, "title:foo") {
+		t.Errorf("search returned %s", body)
+	}
+
+	// and the app details must not read the entry of the search "details:x"
+	ctx = fasthttp.RequestCtx{}
+	ctx.Request.SetRequestURI("/search?q=details:x&geo=US")
+	h.Search(&ctx)
+
+	ctx = fasthttp.RequestCtx{}
+	ctx.Request.SetRequestURI("/app/x?geo=US")
+	ctx.SetUserValue("pkgname", "x")
+	h.App(&ctx)
+	if code := ctx.Response.StatusCode(); code != fasthttp.StatusOK {
+		t.Fatalf("app status %d: %s", code, ctx.Response.Body())
+	}
+	if body := string(ctx.Response.Body()); !strings.Contains(body, "App x") {
+		t.Errorf("app returned %s", body)
+	}
+}
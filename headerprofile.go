@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+type HeaderProfileConfig struct {
+	UserAgents     []string
+	Accept         string
+	AcceptLanguage string
+	Headers        map[string]string
+}
+
+// defaultAcceptLanguage is sent by upstreams without a header profile.
+const defaultAcceptLanguage = "{hl},en-US;q=0.8,en;q=0.7"
+
+// defaultUserAgent is sent if no header profile sets a User-Agent.
+const defaultUserAgent = "curl/7.56.0"
+
+// HeaderProfile is the set of request headers an upstream sends, each request
+// takes the next of UserAgents. {hl} in AcceptLanguage is replaced by the
+// language of the request, the header is left out if there is none.
+type HeaderProfile struct {
+	Name           string
+	UserAgents     []string
+	Accept         string
+	AcceptLanguage string
+	Headers        http.Header
+
+	next uint32
+}
+
+func NewHeaderProfiles(configs map[string]HeaderProfileConfig) map[string]*HeaderProfile {
+	profiles := make(map[string]*HeaderProfile, len(configs))
+	for name, c := range configs {
+		p := &HeaderProfile{
+			Name:           name,
+			UserAgents:     c.UserAgents,
+			Accept:         c.Accept,
+			AcceptLanguage: c.AcceptLanguage,
+			Headers:        http.Header{},
+		}
+		for key, value := range c.Headers {
+			p.Headers.Set(key, value)
+		}
+		profiles[name] = p
+	}
+
+	return profiles
+}
+
+// LookupHeaderProfile returns the profile called name, or nil if name is empty.
+func LookupHeaderProfile(profiles map[string]*HeaderProfile, name string) (*HeaderProfile, error) {
+	if name == "" {
+		return nil, nil
+	}
+
+	p, ok := profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown header profile %#v", name)
+	}
+
+	return p, nil
+}
+
+// Header returns the headers of the next request in language lang.
+func (p *HeaderProfile) Header(lang string) http.Header {
+	header := http.Header{}
+
+	acceptLanguage := defaultAcceptLanguage
+	if p != nil {
+		for key, values := range p.Headers {
+			header[key] = append([]string(nil), values...)
+		}
+		if len(p.UserAgents) > 0 {
+			n := atomic.AddUint32(&p.next, 1)
+			header.Set("User-Agent", p.UserAgents[(n-1)%uint32(len(p.UserAgents))])
+		}
+		if p.Accept != "" {
+			header.Set("Accept", p.Accept)
+		}
+		acceptLanguage = p.AcceptLanguage
+	}
+
+	if header.Get("User-Agent") == "" {
+		header.Set("User-Agent", defaultUserAgent)
+	}
+
+	switch {
+	case acceptLanguage == "":
+	case !strings.Contains(acceptLanguage, "{hl}"):
+		header.Set("Accept-Language", acceptLanguage)
+	case lang != "":
+		header.Set("Accept-Language", strings.Replace(acceptLanguage, "{hl}", lang, -1))
+	}
+
+	return header
+}
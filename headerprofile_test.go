@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestHeaderProfileUserAgent(t *testing.T) {
+	profiles := NewHeaderProfiles(map[string]HeaderProfileConfig{
+		"browser": {UserAgents: []string{"a", "b"}},
+		"plain":   {Accept: "text/html"},
+	})
+
+	cases := []struct {
+		profile *HeaderProfile
+		want    []string
+	}{
+		{nil, []string{"curl/7.56.0", "curl/7.56.0"}},
+		{profiles["plain"], []string{"curl/7.56.0", "curl/7.56.0"}},
+		{profiles["browser"], []string{"a", "b", "a"}},
+	}
+
+	for _, c := range cases {
+		for i, want := range c.want {
+			if ua := c.profile.Header("en").Get("User-Agent"); ua != want {
+				t.Errorf("%+v request %d User-Agent %#v, want %#v", c.profile, i, ua, want)
+			}
+		}
+	}
+}
@@ -27,8 +27,14 @@ type FlushWriter struct {
 
 func (fw FlushWriter) Write(p []byte) (n int, err error) {
 	n, err = fw.w.Write(p)
-	if f, ok := fw.w.(http.Flusher); ok {
+	if err != nil {
+		return
+	}
+	switch f := fw.w.(type) {
+	case http.Flusher:
 		f.Flush()
+	case interface{ Flush() error }:
+		err = f.Flush()
 	}
 	return
 }
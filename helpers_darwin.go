@@ -24,6 +24,17 @@ func ReusePortListenUDP(network string, laddr *net.UDPAddr) (*net.UDPConn, error
 	return net.ListenUDP(network, laddr)
 }
 
+// LockFileShared blocks until it holds a shared flock(2) on file.
+func LockFileShared(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_SH)
+}
+
+// TryLockFileExclusive converts the lock on file to an exclusive one, it
+// fails if another process holds a lock on file too.
+func TryLockFileExclusive(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+}
+
 func SetProcessName(name string) error {
 	return nil
 }
@@ -72,6 +72,14 @@ func ReusePortListenUDP(network string, laddr *net.UDPAddr) (*net.UDPConn, error
 	return net.ListenUDP(network, laddr)
 }
 
+func LockFileShared(file *os.File) error {
+	return nil
+}
+
+func TryLockFileExclusive(file *os.File) error {
+	return nil
+}
+
 func SetProcessName(name string) error {
 	return nil
 }
@@ -11,9 +11,15 @@ func Index(ctx *fasthttp.RequestCtx) {
 	fmt.Fprintf(ctx, `Ipinfo lookup:
 
 Usage:
+    curl -v http://%s/ipinfo
     curl -v http://%s/ipinfo/127.0.0.1
+    curl -v http://%s/ipinfo/127.0.0.1?format=text
+    curl -v -d '["1.1.1.1", "8.8.8.8"]' http://%s/ipinfo/batch
+    curl -N --data-binary @ips.txt http://%s/ipinfo/stream
     curl -v -d '{"title": "WhatsApp Messenger", "geo": "IN"}' http://%s/lookup-title
     curl -v -d '{"pkg_name": "com.whatsapp", "geo": "IN"}' http://%s/lookup-pkgname
+    curl -v 'http://%s/search?q=whatsapp&geo=IN&limit=10'
+    curl -v 'http://%s/app/com.whatsapp?geo=IN'
 
-`, host, host, host)
+`, host, host, host, host, host, host, host, host, host)
 }
@@ -1,37 +1,80 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"net"
-	"net/http"
-	"regexp"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/cloudflare/golibs/lrucache"
+	"github.com/json-iterator/go"
 	"github.com/phuslu/glog"
 	"github.com/valyala/fasthttp"
 	"golang.org/x/sync/singleflight"
 )
 
 type IpinfoHandler struct {
-	URL          string
-	Regex        *regexp.Regexp
-	Cache        lrucache.Cache
-	CacheTTL     time.Duration
-	Singleflight *singleflight.Group
-	Transport    *http.Transport
+	Provider         GeoProvider
+	Cache            lrucache.Cache
+	CacheTTL         time.Duration
+	StaleTTL         time.Duration
+	NegativeTTL      time.Duration
+	RefreshInterval  time.Duration
+	Singleflight     *singleflight.Group
+	PrefixLen4       int
+	PrefixLen6       int
+	TrustedProxies   TrustedProxies
+	BatchLimit       int
+	BatchConcurrency int
+	MaxBodySize      int
 }
 
 type IpinfoResponse struct {
-	Error    string `json:"error,omitempty""`
+	Error    string `json:"error,omitempty"`
 	Location string `json:"location,omitempty"`
 	ISP      string `json:"isp,omitempty"`
+	Country  string `json:"country,omitempty"`
+	Region   string `json:"region,omitempty"`
+	City     string `json:"city,omitempty"`
+	ASN      string `json:"asn,omitempty"`
+	Provider string `json:"provider,omitempty"`
+	Prefix   string `json:"prefix,omitempty"`
+	Cache    string `json:"cache,omitempty"`
+}
+
+type IpinfoBatchResponse map[string]IpinfoResponse
+
+func (r IpinfoResponse) Table() ([]string, [][]string) {
+	return []string{"error", "location", "isp", "country", "region", "city", "asn", "provider", "prefix", "cache"},
+		[][]string{{r.Error, r.Location, r.ISP, r.Country, r.Region, r.City, r.ASN, r.Provider, r.Prefix, r.Cache}}
+}
+
+func (r IpinfoBatchResponse) Table() ([]string, [][]string) {
+	ips := make([]string, 0, len(r))
+	for ip := range r {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+
+	header, _ := IpinfoResponse{}.Table()
+	header = append([]string{"ip"}, header...)
+
+	rows := make([][]string, 0, len(ips))
+	for _, ip := range ips {
+		_, row := r[ip].Table()
+		rows = append(rows, append([]string{ip}, row[0]...))
+	}
+
+	return header, rows
 }
 
 func (h *IpinfoHandler) Error(ctx *fasthttp.RequestCtx, err error) {
-	json.NewEncoder(ctx).Encode(IpinfoResponse{
+	Render(ctx, IpinfoResponse{
 		Error: err.Error(),
 	})
 }
@@ -41,77 +84,362 @@ func (h *IpinfoHandler) Ipinfo(ctx *fasthttp.RequestCtx) {
 		glog.Infof("%s \"%s %s\" \"%s\"", ctx.RemoteAddr(), ctx.Method(), ctx.URI(), ctx.UserAgent())
 	}
 
-	var err error
-	var item *IpinfoItem
-
 	ipStr, _ := ctx.UserValue("ip").(string)
 	if ipStr == "" {
-		ipStr, _, _ = net.SplitHostPort(ctx.RemoteAddr().String())
+		ipStr = h.TrustedProxies.ClientIP(ctx)
 	}
 
-	key := "ipinfo:" + ipStr
-	if v, ok := h.Cache.GetNotStale(key); ok {
-		item = v.(*IpinfoItem)
-	} else {
-		item, err = h.ipinfoSearch(ipStr)
-		if err != nil {
-			h.Error(ctx, err)
-			return
+	item, status, err := h.lookup(ipStr)
+	if err != nil {
+		SetErrorStatus(ctx, err)
+		Render(ctx, IpinfoResponse{
+			Error: err.Error(),
+			Cache: status,
+		})
+		return
+	}
+
+	resp := item.Response()
+	resp.Cache = status
+
+	Render(ctx, resp)
+}
+
+func (h *IpinfoHandler) Batch(ctx *fasthttp.RequestCtx) {
+	if glog.V(2) {
+		glog.Infof("%s \"%s %s\" \"%s\"", ctx.RemoteAddr(), ctx.Method(), ctx.URI(), ctx.UserAgent())
+	}
+
+	body, err := ReadRequestBody(ctx, h.MaxBodySize)
+	if err != nil {
+		SetErrorStatus(ctx, err)
+		h.Error(ctx, err)
+		return
+	}
+
+	var ips []string
+
+	err = json.Unmarshal(body, &ips)
+	if err != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		h.Error(ctx, err)
+		return
+	}
+
+	if h.BatchLimit > 0 && len(ips) > h.BatchLimit {
+		ctx.SetStatusCode(fasthttp.StatusRequestEntityTooLarge)
+		h.Error(ctx, fmt.Errorf("too many ips: %d > %d", len(ips), h.BatchLimit))
+		return
+	}
+
+	concurrency := h.BatchConcurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sema := make(chan struct{}, concurrency)
+	results := make(IpinfoBatchResponse, len(ips))
+
+	seen := make(map[string]bool, len(ips))
+
+	for _, ipStr := range ips {
+		if seen[ipStr] {
+			continue
+		}
+		seen[ipStr] = true
+
+		if net.ParseIP(ipStr) == nil {
+			mu.Lock()
+			results[ipStr] = IpinfoResponse{Error: fmt.Sprintf("invalid ip %#v", ipStr)}
+			mu.Unlock()
+			continue
 		}
 
-		h.Cache.Set(key, item, time.Now().Add(h.CacheTTL))
+		sema <- struct{}{}
+		wg.Add(1)
+		go func(ipStr string) {
+			defer func() {
+				<-sema
+				wg.Done()
+			}()
+
+			var resp IpinfoResponse
+			if item, status, err := h.lookup(ipStr); err != nil {
+				resp.Error = err.Error()
+				resp.Cache = status
+			} else {
+				resp = item.Response()
+				resp.Cache = status
+			}
+
+			mu.Lock()
+			results[ipStr] = resp
+			mu.Unlock()
+		}(ipStr)
 	}
 
-	json.NewEncoder(ctx).Encode(IpinfoResponse{
-		Error:    "",
-		Location: item.Location,
-		ISP:      item.ISP,
+	wg.Wait()
+
+	Render(ctx, results)
+}
+
+func (h *IpinfoHandler) Stream(ctx *fasthttp.RequestCtx) {
+	if glog.V(2) {
+		glog.Infof("%s \"%s %s\" \"%s\"", ctx.RemoteAddr(), ctx.Method(), ctx.URI(), ctx.UserAgent())
+	}
+
+	field := string(ctx.QueryArgs().Peek("field"))
+	if field == "" {
+		field = "ip"
+	}
+
+	// the server streams request bodies, lines are enriched as they arrive
+	body := ctx.RequestBodyStream()
+	if body == nil {
+		body = bytes.NewReader(ctx.PostBody())
+	}
+
+	ctx.SetContentType("application/x-ndjson")
+	ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+		h.stream(body, FlushWriter{w}, field)
 	})
 }
 
-type IpinfoItem struct {
-	Location string
-	ISP      string
+// stream reads newline-delimited ips or json objects from r and writes the
+// enriched json lines to w in completion order.
+func (h *IpinfoHandler) stream(r io.Reader, w io.Writer, field string) {
+	concurrency := h.BatchConcurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	lines := make(chan []byte, concurrency)
+	results := make(chan []byte, concurrency)
+	quit := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for line := range lines {
+				results <- h.enrich(line, field)
+			}
+		}()
+	}
+
+	go func() {
+		defer func() {
+			close(lines)
+			wg.Wait()
+			close(results)
+		}()
+
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			line := bytes.TrimSpace(scanner.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+			select {
+			case lines <- append([]byte(nil), line...):
+			case <-quit:
+				return
+			}
+		}
+
+		if err := scanner.Err(); err != nil {
+			glog.Errorf("IpinfoHandler.stream() scan error: %+v", err)
+		}
+	}()
+
+	var err error
+	for result := range results {
+		if err != nil {
+			continue
+		}
+		if _, err = w.Write(result); err != nil {
+			glog.Warningf("IpinfoHandler.stream() write error: %+v", err)
+			close(quit)
+		}
+	}
 }
 
-func (h *IpinfoHandler) ipinfoSearch(ipStr string) (*IpinfoItem, error) {
-	url := strings.Replace(h.URL, "%s", ipStr, 1)
+func (h *IpinfoHandler) enrich(line []byte, field string) []byte {
+	var ipStr string
 
-	req, err := http.NewRequest(http.MethodGet, url, nil)
-	if err != nil {
-		return nil, err
+	obj := make(map[string]jsoniter.RawMessage)
+	if line[0] == '{' {
+		if err := json.Unmarshal(line, &obj); err != nil {
+			data, _ := json.Marshal(map[string]string{"line": string(line), "error": err.Error()})
+			return append(data, '\n')
+		}
+		json.Unmarshal(obj[field], &ipStr)
+	} else {
+		ipStr = string(line)
+		obj[field], _ = json.Marshal(ipStr)
 	}
 
-	req.Header.Set("User-Agent", "curl/7.56.0")
+	var resp IpinfoResponse
+	if net.ParseIP(ipStr) == nil {
+		resp.Error = fmt.Sprintf("invalid ip %#v", ipStr)
+	} else if item, status, err := h.lookup(ipStr); err != nil {
+		resp.Error = err.Error()
+		resp.Cache = status
+	} else {
+		resp = item.Response()
+		resp.Cache = status
+	}
 
-	v, err, _ := h.Singleflight.Do(url, func() (interface{}, error) {
-		return h.Transport.RoundTrip(req)
-	})
-	if err != nil {
-		return nil, err
+	obj["ipinfo"], _ = json.Marshal(resp)
+
+	data, _ := json.Marshal(obj)
+	return append(data, '\n')
+}
+
+func (h *IpinfoHandler) lookup(ipStr string) (*IpinfoItem, string, error) {
+	key := "ipinfo:" + ipStr
+	prefix := h.prefix(ipStr)
+
+	// neighbors in the same prefix share one upstream lookup
+	sfKey := key
+	if prefix != "" {
+		sfKey = "ipinfo-prefix:" + prefix
 	}
 
-	resp := v.(*http.Response)
-	defer resp.Body.Close()
+	refresh := func() (interface{}, error) {
+		item, err := h.Provider.Lookup(ipStr)
+		if err != nil {
+			if Cacheable(err) {
+				CacheStoreNegative(h.Cache, key, nil, err, h.NegativeTTL)
+			}
+			return nil, err
+		}
+
+		CacheStore(h.Cache, key, item, h.CacheTTL, h.StaleTTL)
+
+		if prefix == "" {
+			return item, nil
+		}
+
+		neighbor := *item
+		neighbor.Prefix = prefix
+		CacheStore(h.Cache, "ipinfo-prefix:"+prefix, &neighbor, h.CacheTTL, h.StaleTTL)
+
+		return &neighbor, nil
+	}
 
-	data, err := ioutil.ReadAll(resp.Body)
+	keys := []string{key}
+	if prefix != "" {
+		keys = append(keys, "ipinfo-prefix:"+prefix)
+	}
+
+	for _, k := range keys {
+		e, status, ok := CacheLoad(h.Cache, k)
+		if !ok {
+			continue
+		}
+		if status == CacheStale && e.Revalidate(h.RefreshInterval) {
+			go h.Singleflight.Do(sfKey, refresh)
+		}
+		if e.Err != nil {
+			return nil, status, e.Err
+		}
+		return e.Value.(*IpinfoItem), status, nil
+	}
+
+	v, err, _ := h.Singleflight.Do(sfKey, refresh)
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+
+	if e, _, ok := CacheLoad(h.Cache, key); ok && e.Err == nil {
+		return e.Value.(*IpinfoItem), CacheFresh, nil
+	}
+
+	return v.(*IpinfoItem), CacheFresh, nil
+}
+
+// prefix returns the cidr network of ipStr used as the neighbor cache key,
+// or an empty string if prefix caching is disabled for its address family.
+func (h *IpinfoHandler) prefix(ipStr string) string {
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return ""
+	}
+
+	bits, ones := 128, h.PrefixLen6
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits, ones = ip4, 32, h.PrefixLen4
 	}
 
-	match := h.Regex.FindStringSubmatch(string(data))
-	if match == nil {
-		return nil, fmt.Errorf("empty")
+	if ones <= 0 || ones >= bits {
+		return ""
 	}
 
-	item := &IpinfoItem{
-		Location: match[1],
-		ISP:      match[2],
+	mask := net.CIDRMask(ones, bits)
+	return (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String()
+}
+
+type IpinfoItem struct {
+	Location string
+	ISP      string
+	Country  string
+	Region   string
+	City     string
+	ASN      string
+	Provider string
+	Prefix   string
+}
+
+// SetField sets the field by its extraction name, e.g. the regex group name.
+func (item *IpinfoItem) SetField(name, value string) bool {
+	switch name {
+	case "location":
+		item.Location = value
+	case "isp":
+		item.ISP = value
+	case "country":
+		item.Country = value
+	case "region":
+		item.Region = value
+	case "city":
+		item.City = value
+	case "asn":
+		item.ASN = value
+	default:
+		return false
 	}
+	return true
+}
 
-	glog.Infof("ipinfoSearch(%#v) return %+v", ipStr, item)
+func (item *IpinfoItem) Response() IpinfoResponse {
+	return IpinfoResponse{
+		Location: item.Location,
+		ISP:      item.ISP,
+		Country:  item.Country,
+		Region:   item.Region,
+		City:     item.City,
+		ASN:      item.ASN,
+		Provider: item.Provider,
+		Prefix:   item.Prefix,
+	}
+}
 
-	h.Singleflight.Forget(url)
+// Normalize fills the legacy location field from the structured ones.
+func (item *IpinfoItem) Normalize() {
+	if item.Location != "" {
+		return
+	}
 
-	return item, nil
+	var names []string
+	for _, name := range []string{item.Country, item.Region, item.City} {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	item.Location = strings.Join(names, " ")
 }
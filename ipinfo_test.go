@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/golibs/lrucache"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+	"golang.org/x/sync/singleflight"
+)
+
+type staticGeoProvider struct{}
+
+func (p staticGeoProvider) Name() string {
+	return "static"
+}
+
+func (p staticGeoProvider) Lookup(ipStr string) (*IpinfoItem, error) {
+	return &IpinfoItem{Location: "test", Provider: p.Name()}, nil
+}
+
+func TestIpinfoStreamLargeBody(t *testing.T) {
+	h := &IpinfoHandler{
+		Provider:         staticGeoProvider{},
+		CacheTTL:         time.Minute,
+		Cache:            lrucache.NewLRUCache(1024),
+		Singleflight:     &singleflight.Group{},
+		BatchConcurrency: 4,
+	}
+
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+
+	server := &fasthttp.Server{
+		Handler:           h.Stream,
+		StreamRequestBody: true,
+	}
+	go server.Serve(ln)
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return ln.Dial()
+			},
+		},
+	}
+
+	// more than the default MaxRequestBodySize of 4MB
+	const count = 400000
+
+	body, w := io.Pipe()
+	firstResult := make(chan struct{})
+	go func() {
+		io.WriteString(w, "10.0.0.0\n")
+
+		// the rest of the body is only sent once the first line is answered
+		select {
+		case <-firstResult:
+		case <-time.After(10 * time.Second):
+			w.CloseWithError(fmt.Errorf("no result before the end of the body"))
+			return
+		}
+
+		bw := bufio.NewWriter(w)
+		for i := 1; i < count; i++ {
+			fmt.Fprintf(bw, "10.0.%d.%d\n", i/256%256, i%256)
+		}
+		bw.Flush()
+		w.Close()
+	}()
+
+	resp, err := client.Post("http://apiserver/ipinfo/stream", "text/plain", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	n := 0
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if n == 0 {
+			close(firstResult)
+		}
+		n++
+		if line := scanner.Text(); !strings.Contains(line, `"location":"test"`) {
+			t.Fatalf("unexpected line %s", line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n != count {
+		t.Errorf("got %d lines, want %d", n, count)
+	}
+}
+
+func TestIpinfoBatchBodyTooLarge(t *testing.T) {
+	h := &IpinfoHandler{
+		Provider:         staticGeoProvider{},
+		CacheTTL:         time.Minute,
+		Cache:            lrucache.NewLRUCache(1024),
+		Singleflight:     &singleflight.Group{},
+		BatchConcurrency: 4,
+		MaxBodySize:      1024,
+	}
+
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+
+	server := &fasthttp.Server{
+		Handler:            h.Batch,
+		StreamRequestBody:  true,
+		MaxRequestBodySize: 1024,
+	}
+	go server.Serve(ln)
+
+	body := `["10.0.0.1"` + strings.Repeat(`,"10.0.0.1"`, 100000) + `]`
+
+	cases := []struct {
+		header string
+		body   string
+		status int
+	}{
+		{"Content-Length: 12", `["10.0.0.1"]`, fasthttp.StatusOK},
+		{fmt.Sprintf("Content-Length: %d", len(body)), body, fasthttp.StatusRequestEntityTooLarge},
+		{"Transfer-Encoding: chunked", fmt.Sprintf("%x\r\n%s\r\n0\r\n\r\n", len(body), body), fasthttp.StatusRequestEntityTooLarge},
+	}
+
+	for _, c := range cases {
+		conn, err := ln.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the server answers before it has read the body
+		go fmt.Fprintf(conn, "POST /ipinfo/batch HTTP/1.1\r\nHost: apiserver\r\n%s\r\n\r\n%s", c.header, c.body)
+
+		var resp fasthttp.Response
+		if err := resp.Read(bufio.NewReader(conn)); err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+
+		if resp.StatusCode() != c.status {
+			t.Errorf("%s status %d, want %d", c.header, resp.StatusCode(), c.status)
+		}
+	}
+}
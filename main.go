@@ -50,6 +50,12 @@ func main() {
 		glog.Fatalf("NewConfig(%#v) error: %+v", flag.Arg(0), err)
 	}
 
+	// the limit of fasthttp, only /ipinfo/stream reads a longer request body
+	maxRequestBodySize := 4 * 1024 * 1024
+	if config.Default.MaxRequestBodySize > 0 {
+		maxRequestBodySize = config.Default.MaxRequestBodySize
+	}
+
 	// see http.DefaultTransport
 	dialer := &TCPDialer{
 		Resolver: &Resolver{
@@ -70,40 +76,156 @@ func main() {
 			InsecureSkipVerify: true,
 			ClientSessionCache: tls.NewLRUClientSessionCache(2048),
 		},
-		Dial:                  dialer.Dial,
+		DialContext:           dialer.DialContext,
 		MaxIdleConns:          100,
 		IdleConnTimeout:       90 * time.Second,
 		TLSHandshakeTimeout:   10 * time.Second,
 		ExpectContinueTimeout: 1 * time.Second,
 		DisableCompression:    false,
-		Proxy:                 http.ProxyFromEnvironment,
+		Proxy:                 ProxyFromContext,
+	}
+
+	headerProfiles := NewHeaderProfiles(config.HeaderProfiles)
+
+	proxyPools, err := NewProxyPools(config.ProxyPools)
+	if err != nil {
+		glog.Fatalf("NewProxyPools(%+v) error: %+v", config.ProxyPools, err)
+	}
+
+	providers := config.Ipinfo.Providers
+	if config.Ipinfo.Url != "" {
+		providers = append([]IpinfoProviderConfig{{
+			Name:  "default",
+			Url:   config.Ipinfo.Url,
+			Regex: config.Ipinfo.Regex,
+		}}, providers...)
+	}
+
+	var geoProviders []GeoProvider
+	for _, c := range providers {
+		p, err := NewGeoProvider(c, headerProfiles, proxyPools, transport)
+		if err != nil {
+			glog.Fatalf("NewGeoProvider(%+v) error: %+v", c, err)
+		}
+		geoProviders = append(geoProviders, p)
+	}
+	if len(geoProviders) == 0 {
+		glog.Fatalf("no ipinfo provider configured")
+	}
+
+	healthThreshold := 0.5
+	if config.Ipinfo.HealthThreshold > 0 {
+		healthThreshold = config.Ipinfo.HealthThreshold
+	}
+
+	healthRetry := 30 * time.Second
+	if config.Ipinfo.HealthRetry > 0 {
+		healthRetry = time.Duration(config.Ipinfo.HealthRetry) * time.Second
+	}
+
+	trustedProxies, err := ParseTrustedProxies(config.Ipinfo.TrustedProxies)
+	if err != nil {
+		glog.Fatalf("ParseTrustedProxies(%+v) error: %+v", config.Ipinfo.TrustedProxies, err)
+	}
+
+	ipinfoRefresh := time.Minute
+	if config.Ipinfo.RefreshInterval > 0 {
+		ipinfoRefresh = time.Duration(config.Ipinfo.RefreshInterval) * time.Second
+	}
+
+	batchConcurrency := 16
+	if config.Ipinfo.BatchConcurrency > 0 {
+		batchConcurrency = config.Ipinfo.BatchConcurrency
 	}
 
 	ipinfo := &IpinfoHandler{
-		URL:          config.Ipinfo.Url,
-		Regex:        regexp.MustCompile(config.Ipinfo.Regex),
-		CacheTTL:     time.Duration(config.Ipinfo.CacheTtl) * time.Second,
-		Cache:        lrucache.NewLRUCache(10000),
-		Singleflight: &singleflight.Group{},
-		Transport:    transport,
+		Provider:         NewGeoProviderChain(geoProviders, healthThreshold, healthRetry),
+		CacheTTL:         time.Duration(config.Ipinfo.CacheTtl) * time.Second,
+		StaleTTL:         time.Duration(config.Ipinfo.StaleTtl) * time.Second,
+		NegativeTTL:      time.Duration(config.Ipinfo.NegativeTtl) * time.Second,
+		RefreshInterval:  ipinfoRefresh,
+		Cache:            lrucache.NewLRUCache(10000),
+		Singleflight:     &singleflight.Group{},
+		PrefixLen4:       config.Ipinfo.PrefixLen4,
+		PrefixLen6:       config.Ipinfo.PrefixLen6,
+		TrustedProxies:   trustedProxies,
+		BatchLimit:       config.Ipinfo.BatchLimit,
+		BatchConcurrency: batchConcurrency,
+		MaxBodySize:      maxRequestBodySize,
+	}
+
+	var searchRegex *regexp.Regexp
+	if config.Googleplay.SearchRegex != "" {
+		searchRegex = regexp.MustCompile(config.Googleplay.SearchRegex)
+	}
+
+	searchSelector, err := NewSelectorExtractor(config.Googleplay.SearchSelector)
+	if err != nil {
+		glog.Fatalf("NewSelectorExtractor(%+v) error: %+v", config.Googleplay.SearchSelector, err)
+	}
+
+	detailsSelector, err := NewSelectorExtractor(config.Googleplay.DetailsSelector)
+	if err != nil {
+		glog.Fatalf("NewSelectorExtractor(%+v) error: %+v", config.Googleplay.DetailsSelector, err)
+	}
+
+	detailsRegex := make(map[string]*regexp.Regexp)
+	for name, s := range config.Googleplay.DetailsRegex {
+		if !(&AppDetails{}).SetField(name, "") {
+			glog.Fatalf("unknown googleplay details_regex field %#v", name)
+		}
+		detailsRegex[name] = regexp.MustCompile(s)
+	}
+
+	googleplayUpstream, err := NewUpstream("googleplay", config.Googleplay.Upstream, config.Googleplay.Charset, headerProfiles, proxyPools, transport)
+	if err != nil {
+		glog.Fatalf("NewUpstream(%+v) error: %+v", config.Googleplay.Upstream, err)
+	}
+
+	var pkgIndex *PkgIndex
+	if config.Googleplay.IndexFile != "" {
+		pkgIndex, err = OpenPkgIndex(config.Googleplay.IndexFile, time.Duration(config.Googleplay.IndexMaxAge)*time.Second)
+		if err != nil {
+			glog.Fatalf("OpenPkgIndex(%#v) error: %+v", config.Googleplay.IndexFile, err)
+		}
+	}
+
+	googleplayRefresh := time.Minute
+	if config.Googleplay.RefreshInterval > 0 {
+		googleplayRefresh = time.Duration(config.Googleplay.RefreshInterval) * time.Second
 	}
 
 	googleplay := &LookupHandler{
-		SearchURL:    config.Googleplay.SearchUrl,
-		SearchRegex:  regexp.MustCompile(config.Googleplay.SearchRegex),
-		SearchTTL:    time.Duration(config.Googleplay.SearchTtl) * time.Second,
-		SearchCache:  lrucache.NewLRUCache(10000),
-		Singleflight: &singleflight.Group{},
-		Transport:    transport,
+		SearchURL:       config.Googleplay.SearchUrl,
+		SearchRegex:     searchRegex,
+		SearchSelector:  searchSelector,
+		DetailsURL:      config.Googleplay.DetailsUrl,
+		DetailsRegex:    detailsRegex,
+		DetailsSelector: detailsSelector,
+		TitleThreshold:  config.Googleplay.TitleThreshold,
+		SearchTTL:       time.Duration(config.Googleplay.SearchTtl) * time.Second,
+		StaleTTL:        time.Duration(config.Googleplay.StaleTtl) * time.Second,
+		NegativeTTL:     time.Duration(config.Googleplay.NegativeTtl) * time.Second,
+		RefreshInterval: googleplayRefresh,
+		SearchCache:     lrucache.NewLRUCache(10000),
+		Index:           pkgIndex,
+		Singleflight:    &singleflight.Group{},
+		Upstream:        googleplayUpstream,
+		MaxBodySize:     maxRequestBodySize,
 	}
 
 	router := fasthttprouter.New()
 	router.GET("/", Index)
 	router.GET("/metrics", Metrics)
 	router.GET("/debug/pprof/*profile", Pprof)
+	router.GET("/ipinfo", ipinfo.Ipinfo)
 	router.GET("/ipinfo/:ip", ipinfo.Ipinfo)
+	router.POST("/ipinfo/batch", ipinfo.Batch)
+	router.POST("/ipinfo/stream", ipinfo.Stream)
 	router.POST("/lookup-title", googleplay.LookupTitle)
 	router.POST("/lookup-pkgname", googleplay.LookupPackageName)
+	router.GET("/search", googleplay.Search)
+	router.GET("/app/:pkgname", googleplay.App)
 
 	ln, err := ReusePortListen("tcp", config.Default.ListenAddr)
 	if err != nil {
@@ -111,7 +233,13 @@ func main() {
 	}
 
 	glog.Infof("apiserver %s ListenAndServe on %s\n", version, ln.Addr().String())
-	go fasthttp.Serve(ln, router.Handler)
+	server := &fasthttp.Server{
+		Handler:            router.Handler,
+		StreamRequestBody:  true,
+		MaxRequestBodySize: maxRequestBodySize,
+	}
+
+	go server.Serve(ln)
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGHUP)
@@ -119,6 +247,9 @@ func main() {
 	switch <-c {
 	case syscall.SIGHUP:
 	default:
+		if pkgIndex != nil {
+			pkgIndex.Close()
+		}
 		glog.Infof("apiserver server closed.")
 		os.Exit(0)
 	}
@@ -155,5 +286,12 @@ func main() {
 
 	time.Sleep(timeout)
 
+	// releases the lock on the index file, so that the next start may compact it
+	if pkgIndex != nil {
+		if err := pkgIndex.Close(); err != nil {
+			glog.Errorf("%T.Close() error: %+v", pkgIndex, err)
+		}
+	}
+
 	glog.Infof("apiserver server shutdown.")
 }
@@ -15,10 +15,37 @@ type MetricsFooKey struct {
 	Key2 string
 }
 
+type MetricsIpinfoProviderKey struct {
+	Provider string
+	Result   string
+}
+
+type MetricsProxyKey struct {
+	Pool  string
+	Proxy string
+}
+
+type MetricsUpstreamKey struct {
+	Upstream string
+	Event    string
+}
+
 var (
-	MetricsFooCounter sync.Map // map[MetricsFooKey]*int64
+	MetricsFooCounter            sync.Map // map[MetricsFooKey]*int64
+	MetricsIpinfoProviderCounter sync.Map // map[MetricsIpinfoProviderKey]*int64
+	MetricsIpinfoProviderHealth  sync.Map // map[string]*GeoProviderHealth
+	MetricsUpstreamCounter       sync.Map // map[MetricsUpstreamKey]*int64
+	MetricsProxyHealth           sync.Map // map[MetricsProxyKey]*Proxy
 )
 
+func IncMetricsCounter(m *sync.Map, key interface{}) {
+	v, ok := m.Load(key)
+	if !ok {
+		v, _ = m.LoadOrStore(key, new(int64))
+	}
+	atomic.AddInt64(v.(*int64), 1)
+}
+
 func Metrics(ctx *fasthttp.RequestCtx) {
 	var w io.Writer = ctx
 	if ctx.Request.Header.HasAcceptEncoding("gzip") {
@@ -39,4 +66,47 @@ func Metrics(ctx *fasthttp.RequestCtx) {
 		fmt.Fprintf(w, "apiserver_foo_count{key1=\"%s\",key2=\"%s\"} %d\n", k.Key1, k.Key2, v)
 		return true
 	})
+
+	io.WriteString(w, "# HELP apiserver_ipinfo_provider_requests_total ipinfo provider lookups\n")
+	io.WriteString(w, "# TYPE apiserver_ipinfo_provider_requests_total counter\n")
+	MetricsIpinfoProviderCounter.Range(func(key, value interface{}) bool {
+		k := key.(MetricsIpinfoProviderKey)
+		v := atomic.LoadInt64(value.(*int64))
+		fmt.Fprintf(w, "apiserver_ipinfo_provider_requests_total{provider=\"%s\",result=\"%s\"} %d\n", k.Provider, k.Result, v)
+		return true
+	})
+
+	io.WriteString(w, "# HELP apiserver_ipinfo_provider_health ipinfo provider health score, error rate and latency seconds\n")
+	io.WriteString(w, "# TYPE apiserver_ipinfo_provider_health gauge\n")
+	MetricsIpinfoProviderHealth.Range(func(key, value interface{}) bool {
+		h := value.(*GeoProviderHealth)
+		errors, latency := h.Stats()
+		fmt.Fprintf(w, "apiserver_ipinfo_provider_health{provider=\"%s\",kind=\"score\"} %g\n", key, h.Score())
+		fmt.Fprintf(w, "apiserver_ipinfo_provider_health{provider=\"%s\",kind=\"errors\"} %g\n", key, errors)
+		fmt.Fprintf(w, "apiserver_ipinfo_provider_health{provider=\"%s\",kind=\"latency\"} %g\n", key, latency)
+		return true
+	})
+
+	io.WriteString(w, "# HELP apiserver_upstream_events_total upstream retries, hedged requests, oversized responses and proxy ejections\n")
+	io.WriteString(w, "# TYPE apiserver_upstream_events_total counter\n")
+	MetricsUpstreamCounter.Range(func(key, value interface{}) bool {
+		k := key.(MetricsUpstreamKey)
+		v := atomic.LoadInt64(value.(*int64))
+		fmt.Fprintf(w, "apiserver_upstream_events_total{upstream=\"%s\",event=\"%s\"} %d\n", k.Upstream, k.Event, v)
+		return true
+	})
+
+	io.WriteString(w, "# HELP apiserver_proxy_health egress proxy success rate and whether it is ejected\n")
+	io.WriteString(w, "# TYPE apiserver_proxy_health gauge\n")
+	MetricsProxyHealth.Range(func(key, value interface{}) bool {
+		k := key.(MetricsProxyKey)
+		success, ejected := value.(*Proxy).Stats()
+		var e int
+		if ejected {
+			e = 1
+		}
+		fmt.Fprintf(w, "apiserver_proxy_health{pool=\"%s\",proxy=\"%s\",kind=\"success\"} %g\n", k.Pool, k.Proxy, success)
+		fmt.Fprintf(w, "apiserver_proxy_health{pool=\"%s\",proxy=\"%s\",kind=\"ejected\"} %d\n", k.Pool, k.Proxy, e)
+		return true
+	})
 }
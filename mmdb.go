@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+)
+
+// see https://maxmind.github.io/MaxMind-DB/
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+type MMDBMetadata struct {
+	NodeCount    uint
+	RecordSize   uint
+	IPVersion    uint
+	DatabaseType string
+	BuildEpoch   uint
+}
+
+type MMDBReader struct {
+	Metadata MMDBMetadata
+
+	buf       []byte
+	data      []byte
+	nodeSize  uint
+	ipv4Start uint
+}
+
+func OpenMMDB(filename string) (*MMDBReader, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return NewMMDBReader(buf)
+}
+
+func NewMMDBReader(buf []byte) (*MMDBReader, error) {
+	start := len(buf) - 128*1024
+	if start < 0 {
+		start = 0
+	}
+
+	pos := bytes.LastIndex(buf[start:], mmdbMetadataMarker)
+	if pos < 0 {
+		return nil, fmt.Errorf("mmdb: invalid database, metadata marker not found")
+	}
+	pos += start + len(mmdbMetadataMarker)
+
+	v, _, err := mmdbDecoder{buf[pos:]}.decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("mmdb: decode metadata error: %+v", err)
+	}
+
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("mmdb: invalid metadata %T", v)
+	}
+
+	r := &MMDBReader{buf: buf}
+	r.Metadata.NodeCount = mmdbUint(m["node_count"])
+	r.Metadata.RecordSize = mmdbUint(m["record_size"])
+	r.Metadata.IPVersion = mmdbUint(m["ip_version"])
+	r.Metadata.DatabaseType, _ = m["database_type"].(string)
+	r.Metadata.BuildEpoch = mmdbUint(m["build_epoch"])
+
+	switch r.Metadata.RecordSize {
+	case 24, 28, 32:
+		r.nodeSize = r.Metadata.RecordSize / 4
+	default:
+		return nil, fmt.Errorf("mmdb: unsupported record size %d", r.Metadata.RecordSize)
+	}
+
+	// the search tree and the data section come before the metadata, a file
+	// copied in halfway may lack some of them
+	dataEnd := uint(pos - len(mmdbMetadataMarker))
+	if r.Metadata.NodeCount > dataEnd || r.Metadata.NodeCount*r.nodeSize+16 > dataEnd {
+		return nil, fmt.Errorf("mmdb: invalid node count %d", r.Metadata.NodeCount)
+	}
+	r.data = buf[r.Metadata.NodeCount*r.nodeSize+16 : dataEnd]
+
+	if r.Metadata.IPVersion == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < r.Metadata.NodeCount; i++ {
+			node = r.readNode(node, 0)
+		}
+		r.ipv4Start = node
+	}
+
+	return r, nil
+}
+
+// Lookup returns the record of ip and the prefix length of the network it belongs to,
+// a nil record means that ip is not in the database.
+func (r *MMDBReader) Lookup(ip net.IP) (interface{}, int, error) {
+	node := uint(0)
+	prefix := 0
+
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		node = r.ipv4Start
+	} else if r.Metadata.IPVersion == 4 {
+		return nil, 0, fmt.Errorf("mmdb: cannot lookup IPv6 address %s in an IPv4-only database", ip)
+	}
+
+	count := r.Metadata.NodeCount
+	for i := 0; i < len(ip)*8 && node < count; i++ {
+		bit := uint(ip[i>>3]>>(7-uint(i&7))) & 1
+		node = r.readNode(node, bit)
+		prefix++
+	}
+
+	switch {
+	case node == count:
+		return nil, prefix, nil
+	case node < count:
+		return nil, 0, fmt.Errorf("mmdb: invalid search tree for %s", ip)
+	}
+
+	offset := node - count - 16
+	if offset >= uint(len(r.data)) {
+		return nil, 0, fmt.Errorf("mmdb: invalid data pointer %d", offset)
+	}
+
+	v, _, err := mmdbDecoder{r.data}.decode(offset, 0)
+	return v, prefix, err
+}
+
+func (r *MMDBReader) readNode(node, bit uint) uint {
+	b := r.buf[node*r.nodeSize:]
+	switch r.Metadata.RecordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+const (
+	mmdbExtended = iota
+	mmdbPointer
+	mmdbString
+	mmdbFloat64
+	mmdbBytes
+	mmdbUint16
+	mmdbUint32
+	mmdbMap
+	mmdbInt32
+	mmdbUint64
+	mmdbUint128
+	mmdbSlice
+	mmdbContainer
+	mmdbEndMarker
+	mmdbBool
+	mmdbFloat32
+)
+
+// mmdbMaxDepth limits the nesting of maps, slices and pointers, so that a
+// corrupt file with a pointer cycle fails instead of overflowing the stack.
+const mmdbMaxDepth = 512
+
+type mmdbDecoder struct {
+	buf []byte
+}
+
+func (d mmdbDecoder) decode(offset uint, depth int) (interface{}, uint, error) {
+	if offset >= uint(len(d.buf)) {
+		return nil, 0, fmt.Errorf("mmdb: unexpected end of data at %d", offset)
+	}
+
+	if depth > mmdbMaxDepth {
+		return nil, 0, fmt.Errorf("mmdb: data nested deeper than %d at %d", mmdbMaxDepth, offset)
+	}
+
+	ctrl := d.buf[offset]
+	offset++
+
+	kind := uint(ctrl >> 5)
+	if kind == mmdbPointer {
+		pointer, next, err := d.pointer(ctrl, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		// a pointer to a pointer is invalid, see the spec
+		if pointer < uint(len(d.buf)) && uint(d.buf[pointer]>>5) == mmdbPointer {
+			return nil, 0, fmt.Errorf("mmdb: invalid pointer to pointer at %d", offset-1)
+		}
+		v, _, err := d.decode(pointer, depth+1)
+		return v, next, err
+	}
+
+	if kind == mmdbExtended {
+		if offset >= uint(len(d.buf)) {
+			return nil, 0, fmt.Errorf("mmdb: unexpected end of data at %d", offset)
+		}
+		kind = 7 + uint(d.buf[offset])
+		offset++
+	}
+
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > uint(len(d.buf)) {
+			return nil, 0, fmt.Errorf("mmdb: unexpected end of data at %d", offset)
+		}
+		v := mmdbBigEndian(d.buf[offset : offset+n])
+		switch n {
+		case 1:
+			size = 29 + v
+		case 2:
+			size = 285 + v
+		default:
+			size = 65821 + v
+		}
+		offset += n
+	}
+
+	// every entry takes at least one byte, a corrupt size must not allocate
+	if (kind == mmdbMap || kind == mmdbSlice) && size > uint(len(d.buf))-offset {
+		return nil, 0, fmt.Errorf("mmdb: invalid size %d at %d", size, offset)
+	}
+
+	switch kind {
+	case mmdbMap:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			k, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("mmdb: invalid map key %T at %d", k, offset)
+			}
+			v, next, err := d.decode(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[key] = v
+			offset = next
+		}
+		return m, offset, nil
+	case mmdbSlice:
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			v, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			offset = next
+		}
+		return a, offset, nil
+	case mmdbBool:
+		return size != 0, offset, nil
+	case mmdbContainer, mmdbEndMarker:
+		return nil, offset, nil
+	}
+
+	if offset+size > uint(len(d.buf)) {
+		return nil, 0, fmt.Errorf("mmdb: unexpected end of data at %d", offset)
+	}
+	b := d.buf[offset : offset+size]
+	offset += size
+
+	switch kind {
+	case mmdbString:
+		return string(b), offset, nil
+	case mmdbBytes:
+		return append([]byte(nil), b...), offset, nil
+	case mmdbFloat64:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("mmdb: invalid double size %d", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case mmdbFloat32:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("mmdb: invalid float size %d", size)
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64:
+		if size > 8 {
+			return nil, 0, fmt.Errorf("mmdb: invalid uint size %d", size)
+		}
+		return uint64(mmdbBigEndian(b)), offset, nil
+	case mmdbInt32:
+		if size > 4 {
+			return nil, 0, fmt.Errorf("mmdb: invalid int32 size %d", size)
+		}
+		return int64(int32(uint32(mmdbBigEndian(b)))), offset, nil
+	case mmdbUint128:
+		return append([]byte(nil), b...), offset, nil
+	default:
+		return nil, 0, fmt.Errorf("mmdb: unknown data type %d at %d", kind, offset)
+	}
+}
+
+func (d mmdbDecoder) pointer(ctrl byte, offset uint) (uint, uint, error) {
+	n := uint(ctrl>>3)&0x3 + 1
+	if offset+n > uint(len(d.buf)) {
+		return 0, 0, fmt.Errorf("mmdb: unexpected end of data at %d", offset)
+	}
+
+	v := mmdbBigEndian(d.buf[offset : offset+n])
+	switch n {
+	case 1:
+		v |= uint(ctrl&0x7) << 8
+	case 2:
+		v = v | uint(ctrl&0x7)<<16 + 2048
+	case 3:
+		v = v | uint(ctrl&0x7)<<24 + 526336
+	}
+
+	return v, offset + n, nil
+}
+
+func mmdbBigEndian(b []byte) uint {
+	var v uint
+	for _, c := range b {
+		v = v<<8 | uint(c)
+	}
+	return v
+}
+
+func mmdbUint(v interface{}) uint {
+	if n, ok := v.(uint64); ok {
+		return uint(n)
+	}
+	return 0
+}
+
+// MMDBString walks into a decoded record by keys or slice indexes, e.g.
+// MMDBString(record, "city", "names", "en")
+func MMDBString(v interface{}, path ...interface{}) string {
+	for _, p := range path {
+		switch k := p.(type) {
+		case string:
+			m, _ := v.(map[string]interface{})
+			v = m[k]
+		case int:
+			a, _ := v.([]interface{})
+			if k >= len(a) {
+				return ""
+			}
+			v = a[k]
+		}
+	}
+
+	switch v := v.(type) {
+	case string:
+		return v
+	case uint64:
+		return fmt.Sprint(v)
+	}
+	return ""
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// testdata/test.mmdb is an ipv6 database with record size 24, it has
+// 1.2.3.0/24 (Testville, Testland) and 2001:db8::/32 (Docland).
+const testMMDB = "testdata/test.mmdb"
+
+func TestMMDBLookup(t *testing.T) {
+	r, err := OpenMMDB(testMMDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.Metadata.IPVersion != 6 || r.Metadata.RecordSize != 24 || r.Metadata.DatabaseType != "Apiserver-Test" {
+		t.Errorf("unexpected metadata %+v", r.Metadata)
+	}
+
+	cases := []struct {
+		ip      string
+		prefix  int
+		country string
+		city    string
+	}{
+		{"1.2.3.4", 24, "Testland", "Testville"},
+		{"1.2.3.255", 24, "Testland", "Testville"},
+		{"::ffff:1.2.3.4", 24, "Testland", "Testville"},
+		{"1.2.4.1", 22, "", ""},
+		{"2001:db8::1", 32, "Docland", ""},
+		{"2001:db9::1", 32, "", ""},
+	}
+
+	for _, c := range cases {
+		record, prefix, err := r.Lookup(net.ParseIP(c.ip))
+		if err != nil {
+			t.Errorf("Lookup(%s) error: %+v", c.ip, err)
+			continue
+		}
+		if prefix != c.prefix {
+			t.Errorf("Lookup(%s) prefix %d, want %d", c.ip, prefix, c.prefix)
+		}
+		if c.country == "" && record != nil {
+			t.Errorf("Lookup(%s) = %+v, want no record", c.ip, record)
+		}
+		if country := MMDBString(record, "country", "names", "en"); country != c.country {
+			t.Errorf("Lookup(%s) country %#v, want %#v", c.ip, country, c.country)
+		}
+		if city := MMDBString(record, "city", "names", "en"); city != c.city {
+			t.Errorf("Lookup(%s) city %#v, want %#v", c.ip, city, c.city)
+		}
+	}
+
+	record, _, _ := r.Lookup(net.ParseIP("1.2.3.4"))
+	if asn := MMDBString(record, "autonomous_system_number"); asn != "64500" {
+		t.Errorf("asn %#v, want 64500", asn)
+	}
+	if region := MMDBString(record, "subdivisions", 0, "names", "en"); region != "Test Region" {
+		t.Errorf("region %#v, want Test Region", region)
+	}
+}
+
+func TestMMDBTruncated(t *testing.T) {
+	buf, err := ioutil.ReadFile(testMMDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the metadata alone names a search tree which is not there
+	pos := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if _, err := NewMMDBReader(buf[pos:]); err == nil {
+		t.Errorf("NewMMDBReader(metadata only) returns no error")
+	}
+
+	// any part of the file either fails to open or to look up, but never panics
+	for i := 0; i < len(buf); i++ {
+		for _, b := range [][]byte{buf[:i], buf[i:]} {
+			r, err := NewMMDBReader(b)
+			if err != nil {
+				continue
+			}
+			for _, ip := range []string{"1.2.3.4", "1.2.4.1", "2001:db8::1"} {
+				r.Lookup(net.ParseIP(ip))
+			}
+		}
+	}
+}
+
+func TestMMDBPointerLoop(t *testing.T) {
+	cases := map[string][]byte{
+		// a pointer to itself
+		"self pointer": {0x20, 0x00},
+		// a pointer to the pointer after it
+		"pointer to pointer": {0x20, 0x02, 0x20, 0x00},
+		// a map {"a": pointer to the map}
+		"map cycle": {0xe1, 0x41, 'a', 0x20, 0x00},
+	}
+
+	for name, buf := range cases {
+		if _, _, err := (mmdbDecoder{buf}).decode(0, 0); err == nil {
+			t.Errorf("%s: decode returns no error", name)
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/phuslu/glog"
+)
+
+// pkgIndexTouchInterval limits how often a known pair is rewritten to disk
+// only to advance its last seen time.
+const pkgIndexTouchInterval = time.Hour
+
+type PkgIndexEntry struct {
+	GEO         string `json:"geo"`
+	PackageName string `json:"pkg_name"`
+	Title       string `json:"title"`
+	FirstSeen   int64  `json:"first_seen"`
+	LastSeen    int64  `json:"last_seen"`
+
+	persisted int64
+}
+
+// PkgIndex records every (pkg_name, title) pair seen per geo. It is kept in
+// memory and backed by an append-only json lines file, each batch is written
+// by a single write(2) so that the file survives crashes and the overlap of
+// parent and child around a SIGHUP re-exec.
+type PkgIndex struct {
+	MaxAge time.Duration
+
+	mu      sync.RWMutex
+	file    *os.File
+	entries map[string]*PkgIndexEntry   // geo, pkg_name and title
+	pkgs    map[string]*PkgIndexEntry   // geo and pkg_name, the last seen title
+	titles  map[string][]*PkgIndexEntry // geo and normalized title
+}
+
+func OpenPkgIndex(filename string, maxAge time.Duration) (*PkgIndex, error) {
+	x := &PkgIndex{
+		MaxAge:  maxAge,
+		entries: make(map[string]*PkgIndexEntry),
+		pkgs:    make(map[string]*PkgIndexEntry),
+		titles:  make(map[string][]*PkgIndexEntry),
+	}
+
+	file, err := openLockedFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	lines, err := x.load(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	x.evict()
+
+	x.file = file
+	if lines > 2*len(x.entries)+1024 {
+		if err := x.compact(filename); err != nil {
+			glog.Warningf("PkgIndex.compact(%#v) error: %+v", filename, err)
+		}
+	}
+
+	glog.Infof("OpenPkgIndex(%#v) load %d pairs from %d lines", filename, len(x.entries), lines)
+
+	return x, nil
+}
+
+// openLockedFile opens filename for appending with a shared lock, every
+// process holds one as long as it writes to the file.
+func openLockedFile(filename string) (*os.File, error) {
+	for {
+		file, err := os.OpenFile(filename, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := LockFileShared(file); err != nil {
+			file.Close()
+			return nil, err
+		}
+
+		// the file may have been replaced by a compaction meanwhile
+		fi1, err1 := file.Stat()
+		fi2, err2 := os.Stat(filename)
+		if err1 == nil && err2 == nil && os.SameFile(fi1, fi2) {
+			return file, nil
+		}
+
+		file.Close()
+	}
+}
+
+func (x *PkgIndex) load(file *os.File) (int, error) {
+	lines := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		lines++
+
+		var e PkgIndexEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// a torn line of an interrupted write
+			continue
+		}
+
+		e.persisted = e.LastSeen
+		x.merge(&e)
+	}
+
+	return lines, scanner.Err()
+}
+
+// evict drops the pairs not seen for MaxAge. It must be called with mu held
+// or before x is shared.
+func (x *PkgIndex) evict() {
+	for key, e := range x.entries {
+		if !x.fresh(e) {
+			delete(x.entries, key)
+		}
+	}
+
+	for key, e := range x.pkgs {
+		if !x.fresh(e) {
+			delete(x.pkgs, key)
+		}
+	}
+
+	for key, entries := range x.titles {
+		fresh := entries[:0]
+		for _, e := range entries {
+			if x.fresh(e) {
+				fresh = append(fresh, e)
+			}
+		}
+		if len(fresh) == 0 {
+			delete(x.titles, key)
+		} else {
+			x.titles[key] = fresh
+		}
+	}
+}
+
+// compact rewrites the file with one line per pair. An older process still
+// appending to the file around a SIGHUP re-exec holds a lock on it, then the
+// compaction is left to the next start.
+func (x *PkgIndex) compact(filename string) error {
+	if err := TryLockFileExclusive(x.file); err != nil {
+		glog.Infof("PkgIndex.compact(%#v) skipped, the file is in use: %+v", filename, err)
+		// a failed conversion may have dropped the shared lock
+		return LockFileShared(x.file)
+	}
+
+	var b bytes.Buffer
+	for _, e := range x.entries {
+		data, _ := json.Marshal(e)
+		b.Write(data)
+		b.WriteByte('\n')
+	}
+
+	tmp := filename + ".tmp"
+	if err := writeFileSync(tmp, b.Bytes()); err != nil {
+		LockFileShared(x.file)
+		return err
+	}
+
+	if err := os.Rename(tmp, filename); err != nil {
+		LockFileShared(x.file)
+		return err
+	}
+
+	file, err := openLockedFile(filename)
+	if err != nil {
+		return err
+	}
+
+	x.file.Close()
+	x.file = file
+
+	return nil
+}
+
+func writeFileSync(filename string, data []byte) error {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err = file.Write(data); err == nil {
+		err = file.Sync()
+	}
+
+	if err1 := file.Close(); err == nil {
+		err = err1
+	}
+
+	return err
+}
+
+// merge adds e or folds its timestamps into the known pair, and returns the
+// indexed entry. It must be called with mu held.
+func (x *PkgIndex) merge(e *PkgIndexEntry) *PkgIndexEntry {
+	key := e.GEO + "\x00" + e.PackageName + "\x00" + e.Title
+
+	old, ok := x.entries[key]
+	if !ok {
+		x.entries[key] = e
+		for _, title := range pkgIndexTitles(e.Title) {
+			k := e.GEO + "\x00" + title
+			x.titles[k] = append(x.titles[k], e)
+		}
+		old = e
+	} else {
+		if e.FirstSeen < old.FirstSeen {
+			old.FirstSeen = e.FirstSeen
+		}
+		if e.LastSeen > old.LastSeen {
+			old.LastSeen = e.LastSeen
+		}
+		if e.persisted > old.persisted {
+			old.persisted = e.persisted
+		}
+	}
+
+	k := e.GEO + "\x00" + e.PackageName
+	if p, ok := x.pkgs[k]; !ok || p.LastSeen <= old.LastSeen {
+		x.pkgs[k] = old
+	}
+
+	return old
+}
+
+// pkgIndexTitles returns the keys a title is indexed by, so that a lookup by
+// a title without its suffix like "- Free" finds it too.
+func pkgIndexTitles(title string) []string {
+	titles := []string{NormalizeTitle(title)}
+	if s := NormalizeTitle(stripTitleSuffix(title)); s != titles[0] && s != "" {
+		titles = append(titles, s)
+	}
+	return titles
+}
+
+// Add records the search results of geo, new pairs and the ones not written
+// for a while are appended to the file.
+func (x *PkgIndex) Add(geo string, items []GoogleplaySearchItem) error {
+	now := time.Now().Unix()
+
+	var b bytes.Buffer
+
+	x.mu.Lock()
+	for _, item := range items {
+		e := x.merge(&PkgIndexEntry{
+			GEO:         geo,
+			PackageName: item.PackageName,
+			Title:       item.Title,
+			FirstSeen:   now,
+			LastSeen:    now,
+		})
+
+		if time.Duration(e.LastSeen-e.persisted)*time.Second < pkgIndexTouchInterval {
+			continue
+		}
+		e.persisted = e.LastSeen
+
+		data, _ := json.Marshal(e)
+		b.Write(data)
+		b.WriteByte('\n')
+	}
+	x.mu.Unlock()
+
+	if b.Len() == 0 {
+		return nil
+	}
+
+	_, err := x.file.Write(b.Bytes())
+	return err
+}
+
+func (x *PkgIndex) fresh(e *PkgIndexEntry) bool {
+	return x.MaxAge <= 0 || time.Since(time.Unix(e.LastSeen, 0)) <= x.MaxAge
+}
+
+// LookupPackageName returns the last title seen for pkgName in geo.
+func (x *PkgIndex) LookupPackageName(geo, pkgName string) (*GoogleplaySearchItem, bool) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	e, ok := x.pkgs[geo+"\x00"+pkgName]
+	if !ok || !x.fresh(e) {
+		return nil, false
+	}
+
+	return &GoogleplaySearchItem{PackageName: e.PackageName, Title: e.Title}, true
+}
+
+// LookupTitle returns the pairs of geo whose normalized title equals the one
+// of title, with or without suffix.
+func (x *PkgIndex) LookupTitle(geo, title string) []GoogleplaySearchItem {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	var items []GoogleplaySearchItem
+
+	seen := make(map[*PkgIndexEntry]bool)
+	for _, t := range pkgIndexTitles(title) {
+		for _, e := range x.titles[geo+"\x00"+t] {
+			if seen[e] || !x.fresh(e) {
+				continue
+			}
+			seen[e] = true
+			items = append(items, GoogleplaySearchItem{PackageName: e.PackageName, Title: e.Title})
+		}
+	}
+
+	return items
+}
+
+func (x *PkgIndex) Close() error {
+	return x.file.Close()
+}
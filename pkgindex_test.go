@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writePkgIndexLines(t *testing.T, filename string, n int, lastSeen int64) {
+	var b bytes.Buffer
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, `{"geo":"US","pkg_name":"com.example","title":"Example","first_seen":%d,"last_seen":%d}`+"\n", lastSeen, lastSeen)
+	}
+	if err := ioutil.WriteFile(filename, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func countLines(t *testing.T, filename string) int {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Count(data, []byte("\n"))
+}
+
+func TestPkgIndexReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pkgindex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "googleplay.index")
+
+	// a pair not seen for a year is dropped on load
+	old := time.Now().Add(-365 * 24 * time.Hour).Unix()
+	if err := ioutil.WriteFile(filename, []byte(fmt.Sprintf(`{"geo":"US","pkg_name":"com.old","title":"Old","first_seen":%d,"last_seen":%d}`+"\n", old, old)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	x, err := OpenPkgIndex(filename, 30*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(x.entries) != 0 || len(x.pkgs) != 0 || len(x.titles) != 0 {
+		t.Errorf("stale pair is kept: %d entries, %d pkgs, %d titles", len(x.entries), len(x.pkgs), len(x.titles))
+	}
+
+	if err := x.Add("US", []GoogleplaySearchItem{{PackageName: "com.example", Title: "Example - Free"}}); err != nil {
+		t.Fatal(err)
+	}
+	x.Close()
+
+	x, err = OpenPkgIndex(filename, 30*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer x.Close()
+
+	if item, ok := x.LookupPackageName("US", "com.example"); !ok || item.Title != "Example - Free" {
+		t.Errorf("LookupPackageName() = %+v, %v", item, ok)
+	}
+	if items := x.LookupTitle("US", "example"); len(items) != 1 {
+		t.Errorf("LookupTitle() = %+v", items)
+	}
+}
+
+func TestPkgIndexCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pkgindex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "googleplay.index")
+	writePkgIndexLines(t, filename, 2000, time.Now().Unix())
+
+	// an older process still appending to the file holds a lock on it
+	parent, err := openLockedFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	x, err := OpenPkgIndex(filename, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := countLines(t, filename); n != 2000 {
+		t.Fatalf("file in use is compacted to %d lines", n)
+	}
+
+	if _, err := parent.WriteString(`{"geo":"US","pkg_name":"com.parent","title":"Parent","first_seen":1,"last_seen":1}` + "\n"); err != nil {
+		t.Fatal(err)
+	}
+	parent.Close()
+
+	if err := x.Add("US", []GoogleplaySearchItem{{PackageName: "com.child", Title: "Child"}}); err != nil {
+		t.Fatal(err)
+	}
+	x.Close()
+
+	// without the older process the file is compacted, keeping the pairs of both
+	x, err = OpenPkgIndex(filename, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := countLines(t, filename); n != 3 {
+		t.Errorf("compacted file has %d lines, want 3", n)
+	}
+
+	if err := x.Add("US", []GoogleplaySearchItem{{PackageName: "com.new", Title: "New"}}); err != nil {
+		t.Fatal(err)
+	}
+	x.Close()
+
+	x, err = OpenPkgIndex(filename, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer x.Close()
+
+	for _, pkgName := range []string{"com.example", "com.parent", "com.child", "com.new"} {
+		if _, ok := x.LookupPackageName("US", pkgName); !ok {
+			t.Errorf("%s is lost", pkgName)
+		}
+	}
+}
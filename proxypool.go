@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ProxyPoolConfig struct {
+	Proxies   []ProxyConfig
+	Threshold float64
+	Cooldown  int
+}
+
+type ProxyConfig struct {
+	Url  string
+	Geos []string
+}
+
+const proxyHealthDecay = 0.2
+
+// ProxyPool is a set of egress proxies for upstream requests. A proxy whose
+// success rate falls below Threshold is ejected for Cooldown. Requests for a
+// geo stick to one available proxy serving it, the others rotate through all
+// available proxies.
+type ProxyPool struct {
+	Name      string
+	Proxies   []*Proxy
+	Threshold float64
+	Cooldown  time.Duration
+
+	mu     sync.Mutex
+	next   int
+	pinned map[string]*Proxy
+}
+
+// Proxy is an http, https or socks5 proxy, Geos are the countries it
+// serves Play results for.
+type Proxy struct {
+	Name string
+	URL  *url.URL
+	Geos []string
+
+	mu      sync.Mutex
+	success float64
+	ejected time.Time
+}
+
+func NewProxyPools(configs map[string]ProxyPoolConfig) (map[string]*ProxyPool, error) {
+	pools := make(map[string]*ProxyPool, len(configs))
+	for name, c := range configs {
+		pool, err := NewProxyPool(name, c)
+		if err != nil {
+			return nil, err
+		}
+		pools[name] = pool
+	}
+
+	return pools, nil
+}
+
+func NewProxyPool(name string, c ProxyPoolConfig) (*ProxyPool, error) {
+	pool := &ProxyPool{
+		Name:      name,
+		Threshold: c.Threshold,
+		Cooldown:  time.Duration(c.Cooldown) * time.Second,
+		pinned:    make(map[string]*Proxy),
+	}
+
+	if pool.Threshold == 0 {
+		pool.Threshold = 0.5
+	}
+
+	if pool.Cooldown == 0 {
+		pool.Cooldown = time.Minute
+	}
+
+	if len(c.Proxies) == 0 {
+		return nil, fmt.Errorf("proxy pool %#v has no proxies", name)
+	}
+
+	for _, pc := range c.Proxies {
+		u, err := url.Parse(pc.Url)
+		if err != nil {
+			return nil, fmt.Errorf("url.Parse(%#v) error: %+v", pc.Url, err)
+		}
+
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return nil, fmt.Errorf("unsupported proxy scheme %#v", u.Scheme)
+		}
+
+		// keep credentials out of logs and metrics
+		redacted := *u
+		redacted.User = nil
+
+		p := &Proxy{
+			Name:    redacted.String(),
+			URL:     u,
+			success: 1,
+		}
+		for _, geo := range pc.Geos {
+			p.Geos = append(p.Geos, strings.ToUpper(geo))
+		}
+
+		pool.Proxies = append(pool.Proxies, p)
+		MetricsProxyHealth.Store(MetricsProxyKey{name, p.Name}, p)
+	}
+
+	return pool, nil
+}
+
+// LookupProxyPool returns the pool called name, or nil if name is empty.
+func LookupProxyPool(pools map[string]*ProxyPool, name string) (*ProxyPool, error) {
+	if name == "" {
+		return nil, nil
+	}
+
+	pool, ok := pools[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown proxy pool %#v", name)
+	}
+
+	return pool, nil
+}
+
+// Select returns the proxy for a request about geo. A geo served by some
+// proxies only goes out through them, the other requests rotate through all
+// proxies. If none is available, it returns nil and the time until one is back.
+func (pool *ProxyPool) Select(geo string) (*Proxy, time.Duration) {
+	now := time.Now()
+
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	if p, ok := pool.pinned[geo]; ok && p.Available(now) {
+		return p, 0
+	}
+
+	var available, serving []*Proxy
+	var wait, servingWait time.Duration
+	served := false
+	for _, p := range pool.Proxies {
+		serves := geo != "" && p.Serves(geo)
+		served = served || serves
+
+		if !p.Available(now) {
+			d := p.EjectedFor(now)
+			if wait == 0 || d < wait {
+				wait = d
+			}
+			if serves && (servingWait == 0 || d < servingWait) {
+				servingWait = d
+			}
+			continue
+		}
+
+		available = append(available, p)
+		if serves {
+			serving = append(serving, p)
+		}
+	}
+
+	if len(serving) > 0 {
+		p := serving[pool.next%len(serving)]
+		pool.next++
+		pool.pinned[geo] = p
+		return p, 0
+	}
+
+	// the results must match the geo, another country's proxy would not do
+	if served {
+		return nil, servingWait
+	}
+
+	if len(available) == 0 {
+		return nil, wait
+	}
+
+	p := available[pool.next%len(available)]
+	pool.next++
+
+	return p, 0
+}
+
+func (p *Proxy) Serves(geo string) bool {
+	for _, g := range p.Geos {
+		if g == geo {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Proxy) Available(now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return !now.Before(p.ejected)
+}
+
+func (p *Proxy) EjectedFor(now time.Time) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.ejected.Sub(now)
+}
+
+// Observe updates the success rate, and ejects the proxy for cooldown when a
+// failure brings it below threshold. A proxy back from its cooldown is ejected
+// again by its next failure unless a success raised the rate first.
+func (p *Proxy) Observe(failed bool, threshold float64, cooldown time.Duration) bool {
+	v := 0.0
+	if !failed {
+		v = 1.0
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.success += proxyHealthDecay * (v - p.success)
+	if failed && p.success < threshold {
+		p.ejected = time.Now().Add(cooldown)
+		return true
+	}
+
+	return false
+}
+
+func (p *Proxy) Stats() (success float64, ejected bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.success, time.Now().Before(p.ejected)
+}
+
+// proxyFailure reports whether err may be the fault of the egress proxy, it
+// could not connect in time or the site blocked or throttled its address.
+func proxyFailure(err error) bool {
+	e, ok := err.(*UpstreamError)
+	if !ok {
+		return true
+	}
+
+	switch e.Kind {
+	case UpstreamTimeout, UpstreamBlocked, UpstreamRateLimited:
+		return true
+	default:
+		return false
+	}
+}
+
+type proxyKey struct{}
+
+// WithProxy sends the requests of ctx through proxy p.
+func WithProxy(ctx context.Context, p *Proxy) context.Context {
+	return context.WithValue(ctx, proxyKey{}, p)
+}
+
+// ProxyFromContext is a http.Transport Proxy func using the proxy of the
+// request context, requests without one use the environment settings.
+func ProxyFromContext(req *http.Request) (*url.URL, error) {
+	if p, ok := req.Context().Value(proxyKey{}).(*Proxy); ok {
+		return p.URL, nil
+	}
+
+	return http.ProxyFromEnvironment(req)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestProxyPool(t *testing.T, cooldown int) *ProxyPool {
+	pool, err := NewProxyPool("test", ProxyPoolConfig{
+		Proxies: []ProxyConfig{
+			{Url: "http://a:1", Geos: []string{"us"}},
+			{Url: "http://b:1", Geos: []string{"US"}},
+			{Url: "http://c:1", Geos: []string{"DE"}},
+		},
+		Cooldown: cooldown,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pool
+}
+
+// eject fails p until it is ejected.
+func eject(t *testing.T, pool *ProxyPool, p *Proxy) {
+	for i := 0; i < 10; i++ {
+		if p.Observe(true, pool.Threshold, pool.Cooldown) {
+			return
+		}
+	}
+	t.Fatalf("%s is not ejected", p.Name)
+}
+
+func TestProxyPoolSelectPinned(t *testing.T) {
+	pool := newTestProxyPool(t, 60)
+
+	p, _ := pool.Select("US")
+	if p == nil || !p.Serves("US") {
+		t.Fatalf("Select(US) = %+v", p)
+	}
+	for i := 0; i < 10; i++ {
+		if q, _ := pool.Select("US"); q != p {
+			t.Fatalf("Select(US) moved from %s to %s", p.Name, q.Name)
+		}
+	}
+
+	// the pin moves to another proxy serving the geo once it is ejected
+	eject(t, pool, p)
+	q, _ := pool.Select("US")
+	if q == nil || q == p || !q.Serves("US") {
+		t.Fatalf("Select(US) after ejecting %s = %+v", p.Name, q)
+	}
+
+	// a geo no proxy serves rotates through all available ones
+	seen := make(map[*Proxy]bool)
+	for i := 0; i < 10; i++ {
+		r, _ := pool.Select("JP")
+		if r == nil || r == p {
+			t.Fatalf("Select(JP) = %+v", r)
+		}
+		seen[r] = true
+	}
+	if len(seen) != 2 {
+		t.Errorf("Select(JP) used %d proxies, want 2", len(seen))
+	}
+}
+
+func TestProxyPoolSelectGeoEjected(t *testing.T) {
+	pool := newTestProxyPool(t, 60)
+
+	for _, p := range pool.Proxies {
+		if p.Serves("US") {
+			eject(t, pool, p)
+		}
+	}
+
+	// no fallback to the DE proxy for US results
+	p, wait := pool.Select("US")
+	if p != nil {
+		t.Fatalf("Select(US) = %s, want none", p.Name)
+	}
+	if wait <= 0 || wait > time.Minute {
+		t.Errorf("Select(US) wait %s", wait)
+	}
+
+	if p, _ := pool.Select("DE"); p == nil || p.Name != "http://c:1" {
+		t.Errorf("Select(DE) = %+v", p)
+	}
+	if p, _ := pool.Select(""); p == nil || p.Name != "http://c:1" {
+		t.Errorf("Select() = %+v", p)
+	}
+}
+
+func TestProxyObserveCooldown(t *testing.T) {
+	pool := newTestProxyPool(t, 60)
+	pool.Cooldown = 50 * time.Millisecond
+	p := pool.Proxies[0]
+
+	// a single failure keeps the success rate above the threshold
+	if p.Observe(true, pool.Threshold, pool.Cooldown) {
+		t.Fatal("ejected after one failure")
+	}
+	p.Observe(false, pool.Threshold, pool.Cooldown)
+
+	eject(t, pool, p)
+	if p.Available(time.Now()) {
+		t.Fatal("ejected proxy is available")
+	}
+	if d := p.EjectedFor(time.Now()); d <= 0 || d > pool.Cooldown {
+		t.Errorf("ejected for %s, want up to %s", d, pool.Cooldown)
+	}
+
+	time.Sleep(pool.Cooldown)
+	if !p.Available(time.Now()) {
+		t.Fatal("proxy is not back after its cooldown")
+	}
+
+	// back from the cooldown, the next failure ejects it again
+	if !p.Observe(true, pool.Threshold, pool.Cooldown) {
+		t.Error("not ejected again by a failure after the cooldown")
+	}
+
+	// and a success in between lets it stay
+	time.Sleep(pool.Cooldown)
+	for i := 0; i < 5; i++ {
+		p.Observe(false, pool.Threshold, pool.Cooldown)
+	}
+	if p.Observe(true, pool.Threshold, pool.Cooldown) {
+		t.Error("ejected by one failure after successes")
+	}
+}
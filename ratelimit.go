@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket of Rate requests per second, it also holds
+// back all requests after the upstream asked to slow down.
+type RateLimiter struct {
+	Rate       float64
+	Burst      float64
+	MaxBackoff time.Duration
+
+	mu      sync.Mutex
+	tokens  float64
+	last    time.Time
+	until   time.Time
+	backoff time.Duration
+}
+
+func NewRateLimiter(rate float64, burst int, maxBackoff time.Duration) *RateLimiter {
+	l := &RateLimiter{
+		Rate:       rate,
+		Burst:      float64(burst),
+		MaxBackoff: maxBackoff,
+	}
+
+	if l.Burst < 1 {
+		l.Burst = 1
+	}
+	l.tokens = l.Burst
+	l.last = time.Now()
+
+	return l
+}
+
+// Wait takes a token and sleeps until it is due, it returns false with the
+// delay at once if the token is not due within maxWait.
+func (l *RateLimiter) Wait(maxWait time.Duration) (time.Duration, bool) {
+	l.mu.Lock()
+
+	now := time.Now()
+	if l.Rate > 0 {
+		l.tokens += now.Sub(l.last).Seconds() * l.Rate
+		if l.tokens > l.Burst {
+			l.tokens = l.Burst
+		}
+	}
+	l.last = now
+
+	var delay time.Duration
+	if l.until.After(now) {
+		delay = l.until.Sub(now)
+	}
+	if l.Rate > 0 && l.tokens < 1 {
+		if d := time.Duration((1 - l.tokens) / l.Rate * float64(time.Second)); d > delay {
+			delay = d
+		}
+	}
+
+	if delay > maxWait {
+		l.mu.Unlock()
+		return delay, false
+	}
+
+	if l.Rate > 0 {
+		l.tokens--
+	}
+
+	l.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+
+	return delay, true
+}
+
+// Backoff holds back requests for retryAfter, or for an exponential backoff
+// if the upstream did not say, the backoff grows only when the upstream still
+// refuses requests after the previous one has passed.
+func (l *RateLimiter) Backoff(retryAfter time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if l.until.Before(now) {
+		switch {
+		case l.backoff == 0:
+			l.backoff = time.Second
+		case l.backoff < l.MaxBackoff:
+			l.backoff *= 2
+		}
+		if l.MaxBackoff > 0 && l.backoff > l.MaxBackoff {
+			l.backoff = l.MaxBackoff
+		}
+	}
+
+	d := l.backoff
+	if retryAfter > d {
+		d = retryAfter
+	}
+
+	if until := now.Add(d); until.After(l.until) {
+		l.until = until
+	}
+}
+
+func (l *RateLimiter) Reset() {
+	l.mu.Lock()
+	l.backoff = 0
+	l.mu.Unlock()
+}
+
+// ParseRetryAfter parses the delay-seconds or http-date form of a Retry-After header.
+func ParseRetryAfter(s string) time.Duration {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0
+	}
+
+	if n, err := strconv.Atoi(s); err == nil {
+		if n < 0 {
+			return 0
+		}
+		return time.Duration(n) * time.Second
+	}
+
+	if t, err := http.ParseTime(s); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Table is implemented by responses which can be rendered as text or csv.
+type Table interface {
+	Table() (header []string, rows [][]string)
+}
+
+var jsonpCallbackRegex = regexp.MustCompile(`^[A-Za-z_$][0-9A-Za-z_$.]*$`)
+
+// Render writes v in the format selected by the ?format= parameter or the
+// Accept header, one of json (default), text, csv and jsonp (with ?callback=).
+func Render(ctx *fasthttp.RequestCtx, v interface{}) {
+	format := NegotiateFormat(ctx)
+
+	t, ok := v.(Table)
+	if !ok && (format == "text" || format == "csv") {
+		format = "json"
+	}
+
+	switch format {
+	case "text":
+		ctx.SetContentType("text/plain; charset=utf-8")
+		header, rows := t.Table()
+		for i, row := range rows {
+			if i > 0 {
+				ctx.WriteString("\n")
+			}
+			for j, value := range row {
+				if value != "" {
+					fmt.Fprintf(ctx, "%s: %s\n", header[j], value)
+				}
+			}
+		}
+	case "csv":
+		ctx.SetContentType("text/csv; charset=utf-8")
+		header, rows := t.Table()
+		w := csv.NewWriter(ctx)
+		w.Write(header)
+		w.WriteAll(rows)
+	case "jsonp":
+		callback := string(ctx.QueryArgs().Peek("callback"))
+		if !jsonpCallbackRegex.MatchString(callback) {
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			ctx.SetContentType("text/plain; charset=utf-8")
+			fmt.Fprintf(ctx, "invalid jsonp callback %#v\n", callback)
+			return
+		}
+		ctx.SetContentType("application/javascript; charset=utf-8")
+		data, _ := json.Marshal(v)
+		fmt.Fprintf(ctx, "%s(%s);\n", callback, data)
+	default:
+		ctx.SetContentType("application/json; charset=utf-8")
+		json.NewEncoder(ctx).Encode(v)
+	}
+}
+
+// NegotiateFormat returns the format of ?format=, jsonp with ?callback=, or
+// the one of the Accept header with the highest q-value, json by default.
+func NegotiateFormat(ctx *fasthttp.RequestCtx) string {
+	if format := string(ctx.QueryArgs().Peek("format")); format != "" {
+		return strings.ToLower(format)
+	}
+
+	if len(ctx.QueryArgs().Peek("callback")) > 0 {
+		return "jsonp"
+	}
+
+	// shared caches must not serve the format negotiated for another Accept
+	ctx.Response.Header.Add("Vary", "Accept")
+
+	format, best := "json", 0.0
+	for _, s := range strings.Split(string(ctx.Request.Header.Peek("Accept")), ",") {
+		params := strings.Split(s, ";")
+
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+
+		// jsonp needs a ?callback=, a javascript Accept falls back to the others
+		var f string
+		switch strings.ToLower(strings.TrimSpace(params[0])) {
+		case "application/json":
+			f = "json"
+		case "text/plain":
+			f = "text"
+		case "text/csv":
+			f = "csv"
+		}
+
+		if f != "" && q > best {
+			format, best = f, q
+		}
+	}
+
+	return format
+}
+
+// RequestBodyTooLargeError is returned by ReadRequestBody for a body larger
+// than its limit.
+type RequestBodyTooLargeError struct {
+	Limit int
+}
+
+func (e *RequestBodyTooLargeError) Error() string {
+	return fmt.Sprintf("request body larger than %d bytes", e.Limit)
+}
+
+func (e *RequestBodyTooLargeError) HTTPStatus() int {
+	return fasthttp.StatusRequestEntityTooLarge
+}
+
+// ReadRequestBody returns the request body of at most limit bytes. The server
+// streams request bodies for /ipinfo/stream, so fasthttp does not limit the
+// size of the others. The rest of a larger body is not read, so the
+// connection is closed after the response.
+func ReadRequestBody(ctx *fasthttp.RequestCtx, limit int) ([]byte, error) {
+	if limit > 0 && ctx.Request.Header.ContentLength() > limit {
+		ctx.SetConnectionClose()
+		return nil, &RequestBodyTooLargeError{limit}
+	}
+
+	r := ctx.RequestBodyStream()
+	if r == nil {
+		body := ctx.PostBody()
+		if limit > 0 && len(body) > limit {
+			return nil, &RequestBodyTooLargeError{limit}
+		}
+		return body, nil
+	}
+
+	if limit <= 0 {
+		return ioutil.ReadAll(r)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > limit {
+		ctx.SetConnectionClose()
+		return nil, &RequestBodyTooLargeError{limit}
+	}
+
+	return body, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	cases := []struct {
+		uri    string
+		accept string
+		format string
+		vary   bool
+	}{
+		{"/ipinfo?format=CSV", "application/json", "csv", false},
+		{"/ipinfo?callback=cb", "text/plain", "jsonp", false},
+		{"/ipinfo", "", "json", true},
+		{"/ipinfo", "text/plain", "text", true},
+		{"/ipinfo", "text/javascript", "json", true},
+		{"/ipinfo", "application/javascript, text/csv", "csv", true},
+		{"/ipinfo", "text/plain;q=0, text/csv;q=0.5", "csv", true},
+		{"/ipinfo", "application/json;q=0.5, text/plain", "text", true},
+		{"/ipinfo", "text/plain; q=0.2, application/json; q=0.9", "json", true},
+		{"/ipinfo", "text/csv;q=0", "json", true},
+	}
+
+	for _, c := range cases {
+		var ctx fasthttp.RequestCtx
+		ctx.Request.SetRequestURI(c.uri)
+		if c.accept != "" {
+			ctx.Request.Header.Set("Accept", c.accept)
+		}
+
+		if format := NegotiateFormat(&ctx); format != c.format {
+			t.Errorf("%s Accept %#v format %s, want %s", c.uri, c.accept, format, c.format)
+		}
+		if vary := string(ctx.Response.Header.Peek("Vary")) == "Accept"; vary != c.vary {
+			t.Errorf("%s Accept %#v Vary: Accept %v, want %v", c.uri, c.accept, vary, c.vary)
+		}
+	}
+}
+
+func TestRenderJavascriptWithoutCallback(t *testing.T) {
+	var ctx fasthttp.RequestCtx
+	ctx.Request.SetRequestURI("/ipinfo")
+	ctx.Request.Header.Set("Accept", "text/javascript")
+
+	Render(&ctx, IpinfoResponse{Location: "test"})
+
+	if code := ctx.Response.StatusCode(); code != fasthttp.StatusOK {
+		t.Errorf("status %d, want 200", code)
+	}
+	if body := string(ctx.Response.Body()); body != "{\"location\":\"test\"}\n" {
+		t.Errorf("body %s", body)
+	}
+}
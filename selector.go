@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/andybalholm/cascadia"
+	"golang.org/x/net/html"
+)
+
+type SelectorConfig struct {
+	Item   string
+	Fields map[string]string
+}
+
+// SelectorExtractor extracts records from a html page by css selectors, each
+// node matched by Item is a record, or the whole page if Item is empty.
+type SelectorExtractor struct {
+	Item   cascadia.Selector
+	Fields map[string]*SelectorRule
+}
+
+// SelectorRule is parsed from "<selector>[@attr][ | regex]", the selector is
+// relative to the record node and may be empty for the node itself, the text
+// of the node is taken unless an attribute is given, the first group of the
+// optional regex (or the whole match) is kept.
+type SelectorRule struct {
+	Selector cascadia.Selector
+	Attr     string
+	Regex    *regexp.Regexp
+}
+
+func NewSelectorExtractor(c SelectorConfig) (*SelectorExtractor, error) {
+	if len(c.Fields) == 0 {
+		return nil, nil
+	}
+
+	e := &SelectorExtractor{
+		Fields: make(map[string]*SelectorRule, len(c.Fields)),
+	}
+
+	if c.Item != "" {
+		sel, err := cascadia.Compile(c.Item)
+		if err != nil {
+			return nil, fmt.Errorf("cascadia.Compile(%#v) error: %+v", c.Item, err)
+		}
+		e.Item = sel
+	}
+
+	for name, s := range c.Fields {
+		rule, err := ParseSelectorRule(s)
+		if err != nil {
+			return nil, err
+		}
+		e.Fields[name] = rule
+	}
+
+	return e, nil
+}
+
+func ParseSelectorRule(s string) (*SelectorRule, error) {
+	rule := &SelectorRule{}
+
+	if i := strings.Index(s, " | "); i >= 0 {
+		regex, err := regexp.Compile(strings.TrimSpace(s[i+3:]))
+		if err != nil {
+			return nil, fmt.Errorf("regexp.Compile(%#v) error: %+v", s[i+3:], err)
+		}
+		rule.Regex = regex
+		s = s[:i]
+	}
+
+	if i := strings.LastIndex(s, "@"); i >= 0 && !strings.ContainsAny(s[i:], "]'\"") {
+		rule.Attr = strings.TrimSpace(s[i+1:])
+		s = s[:i]
+	}
+
+	if s = strings.TrimSpace(s); s != "" {
+		sel, err := cascadia.Compile(s)
+		if err != nil {
+			return nil, fmt.Errorf("cascadia.Compile(%#v) error: %+v", s, err)
+		}
+		rule.Selector = sel
+	}
+
+	return rule, nil
+}
+
+// Extract returns the records having at least one field, in document order.
+func (e *SelectorExtractor) Extract(data string) ([]map[string]string, error) {
+	doc, err := html.Parse(strings.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := []*html.Node{doc}
+	if e.Item != nil {
+		nodes = e.Item.MatchAll(doc)
+	}
+
+	records := make([]map[string]string, 0, len(nodes))
+	for _, node := range nodes {
+		record := make(map[string]string, len(e.Fields))
+		for name, rule := range e.Fields {
+			if value, ok := rule.Value(node); ok {
+				record[name] = value
+			}
+		}
+		if len(record) > 0 {
+			records = append(records, record)
+		}
+	}
+
+	return records, nil
+}
+
+func (r *SelectorRule) Value(node *html.Node) (string, bool) {
+	if r.Selector != nil {
+		if node = r.Selector.MatchFirst(node); node == nil {
+			return "", false
+		}
+	}
+
+	var value string
+	if r.Attr != "" {
+		found := false
+		for _, attr := range node.Attr {
+			if attr.Key == r.Attr {
+				value, found = attr.Val, true
+				break
+			}
+		}
+		if !found {
+			return "", false
+		}
+	} else {
+		value = nodeText(node)
+	}
+
+	if r.Regex != nil {
+		match := r.Regex.FindStringSubmatch(value)
+		switch {
+		case match == nil:
+			return "", false
+		case len(match) > 1:
+			value = match[1]
+		default:
+			value = match[0]
+		}
+	}
+
+	value = strings.TrimSpace(value)
+	return value, value != ""
+}
+
+func nodeText(node *html.Node) string {
+	var b strings.Builder
+
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			b.WriteString(n.Data)
+			b.WriteByte(' ')
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(node)
+
+	return strings.Join(strings.Fields(b.String()), " ")
+}
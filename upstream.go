@@ -0,0 +1,570 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/phuslu/glog"
+	"github.com/valyala/fasthttp"
+)
+
+type UpstreamConfig struct {
+	BlockPatterns    []string
+	Rate             float64
+	Burst            int
+	MaxWait          int
+	MaxBackoff       int
+	ConnectTimeout   int
+	FirstByteTimeout int
+	Timeout          int
+	Retries          int
+	RetryBackoff     float64
+	HedgeDelay       float64
+	MaxBodySize      int64
+	HeaderProfile    string
+	ProxyPool        string
+}
+
+// Upstream fetches the pages of a scraped site and classifies its failures.
+// Requests to each host are rate limited, and held back after a 429 or 503.
+// A request is cancelled once it has not connected within ConnectTimeout, not
+// received the response header within FirstByteTimeout or not finished
+// within Timeout. Failed requests are retried up to Retries times, and a slow
+// request is hedged by a second one after HedgeDelay. A response body larger
+// than MaxBodySize is an error. Requests send the headers of Profile, and go
+// out through a proxy of Proxies if set.
+type Upstream struct {
+	Name             string
+	Charset          string
+	BlockPatterns    []*regexp.Regexp
+	Rate             float64
+	Burst            int
+	MaxWait          time.Duration
+	MaxBackoff       time.Duration
+	ConnectTimeout   time.Duration
+	FirstByteTimeout time.Duration
+	Timeout          time.Duration
+	Retries          int
+	RetryBackoff     time.Duration
+	HedgeDelay       time.Duration
+	MaxBodySize      int64
+	Profile          *HeaderProfile
+	Proxies          *ProxyPool
+	Transport        *http.Transport
+
+	mu       sync.Mutex
+	limiters map[string]*RateLimiter
+}
+
+func NewUpstream(name string, c UpstreamConfig, charset string, profiles map[string]*HeaderProfile, pools map[string]*ProxyPool, transport *http.Transport) (*Upstream, error) {
+	profile, err := LookupHeaderProfile(profiles, c.HeaderProfile)
+	if err != nil {
+		return nil, err
+	}
+
+	proxies, err := LookupProxyPool(pools, c.ProxyPool)
+	if err != nil {
+		return nil, err
+	}
+
+	u := &Upstream{
+		Name:             name,
+		Charset:          charset,
+		Rate:             c.Rate,
+		Burst:            c.Burst,
+		MaxWait:          time.Duration(c.MaxWait) * time.Second,
+		MaxBackoff:       time.Duration(c.MaxBackoff) * time.Second,
+		ConnectTimeout:   time.Duration(c.ConnectTimeout) * time.Second,
+		FirstByteTimeout: time.Duration(c.FirstByteTimeout) * time.Second,
+		Timeout:          time.Duration(c.Timeout) * time.Second,
+		Retries:          c.Retries,
+		RetryBackoff:     time.Duration(c.RetryBackoff * float64(time.Second)),
+		HedgeDelay:       time.Duration(c.HedgeDelay * float64(time.Second)),
+		MaxBodySize:      c.MaxBodySize,
+		Profile:          profile,
+		Proxies:          proxies,
+		Transport:        transport,
+	}
+
+	if u.MaxWait == 0 {
+		u.MaxWait = 2 * time.Second
+	}
+
+	if u.MaxBackoff == 0 {
+		u.MaxBackoff = time.Minute
+	}
+
+	if u.MaxBodySize == 0 {
+		u.MaxBodySize = 8 << 20
+	}
+
+	for _, s := range c.BlockPatterns {
+		regex, err := regexp.Compile(s)
+		if err != nil {
+			return nil, fmt.Errorf("regexp.Compile(%#v) error: %+v", s, err)
+		}
+		u.BlockPatterns = append(u.BlockPatterns, regex)
+	}
+
+	return u, nil
+}
+
+// Header returns the headers of the next request in language lang.
+func (u *Upstream) Header(lang string) http.Header {
+	return u.Profile.Header(lang)
+}
+
+// Get returns the page of url transcoded to utf-8, or an *UpstreamError if
+// the response is not a successful page. Concurrent identical requests are not
+// coalesced here, callers share their parsed results instead.
+//
+// The body is read in chunks, if newDone is not nil, it makes a DoneFunc for
+// every response and the rest of the body is skipped once that reports the
+// page read so far has everything needed. geo is the country the page is
+// about, it picks the egress proxy.
+func (u *Upstream) Get(url, geo string, header http.Header, newDone func() DoneFunc) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	for attempt := 0; ; attempt++ {
+		data, err := u.hedge(req, geo, newDone)
+		if err == nil || attempt >= u.Retries || !retriable(err) {
+			return data, err
+		}
+
+		IncMetricsCounter(&MetricsUpstreamCounter, MetricsUpstreamKey{u.Name, "retry"})
+
+		time.Sleep(u.backoff(attempt))
+	}
+}
+
+// retriable reports whether the request may succeed if sent again, a block
+// page or rate limit is not retried but handled by the limiter.
+func retriable(err error) bool {
+	e, ok := err.(*UpstreamError)
+	if !ok {
+		return true
+	}
+
+	switch e.Kind {
+	case UpstreamTimeout:
+		return true
+	case UpstreamServerError:
+		return e.StatusCode != http.StatusServiceUnavailable
+	default:
+		return false
+	}
+}
+
+// backoff returns the delay before the retry after attempt, an exponential
+// backoff with jitter so that retries of concurrent requests spread out.
+func (u *Upstream) backoff(attempt int) time.Duration {
+	d := u.RetryBackoff << uint(attempt)
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// hedge sends a second request if the first one has not finished within
+// HedgeDelay, the first successful response wins and the other is cancelled.
+func (u *Upstream) hedge(req *http.Request, geo string, newDone func() DoneFunc) (string, error) {
+	if u.HedgeDelay <= 0 {
+		return u.do(context.Background(), req, geo, newDone)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type result struct {
+		data   string
+		err    error
+		hedged bool
+	}
+
+	results := make(chan result, 2)
+	send := func(hedged bool) {
+		go func() {
+			data, err := u.do(ctx, req, geo, newDone)
+			results <- result{data, err, hedged}
+		}()
+	}
+
+	send(false)
+	pending := 1
+
+	timer := time.NewTimer(u.HedgeDelay)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			IncMetricsCounter(&MetricsUpstreamCounter, MetricsUpstreamKey{u.Name, "hedge"})
+			send(true)
+			pending++
+		case r := <-results:
+			pending--
+			if r.err == nil && r.hedged {
+				IncMetricsCounter(&MetricsUpstreamCounter, MetricsUpstreamKey{u.Name, "hedge_win"})
+			}
+			if r.err == nil || pending == 0 {
+				return r.data, r.err
+			}
+		}
+	}
+}
+
+func (u *Upstream) do(parent context.Context, req *http.Request, geo string, newDone func() DoneFunc) (data string, err error) {
+	limiter := u.limiter(req.URL.Host)
+
+	if delay, ok := limiter.Wait(u.MaxWait); !ok {
+		return "", &UpstreamError{
+			Upstream:   u.Name,
+			Kind:       UpstreamBusy,
+			RetryAfter: delay,
+		}
+	}
+
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	if u.Proxies != nil {
+		proxy, wait := u.Proxies.Select(geo)
+		if proxy == nil {
+			detail := "all egress proxies ejected"
+			if geo != "" {
+				detail = fmt.Sprintf("all egress proxies for %s ejected", geo)
+			}
+			return "", &UpstreamError{
+				Upstream:   u.Name,
+				Kind:       UpstreamBusy,
+				RetryAfter: wait,
+				Detail:     detail,
+			}
+		}
+		ctx = WithProxy(ctx, proxy)
+
+		defer func() {
+			// a hedged request cancelled by the winner says nothing about its proxy
+			if parent.Err() == nil {
+				u.observe(proxy, err)
+			}
+		}()
+	}
+
+	if u.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, u.Timeout)
+		defer cancel()
+	}
+
+	if u.ConnectTimeout > 0 {
+		ctx = WithConnectTimeout(ctx, u.ConnectTimeout)
+	}
+
+	var firstByte int32
+	if u.FirstByteTimeout > 0 {
+		timer := time.AfterFunc(u.FirstByteTimeout, func() {
+			if atomic.CompareAndSwapInt32(&firstByte, 0, 1) {
+				cancel()
+			}
+		})
+		defer timer.Stop()
+	}
+
+	resp, err := u.Transport.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		return "", u.timeout(ctx, err, atomic.LoadInt32(&firstByte) == 1)
+	}
+	defer resp.Body.Close()
+
+	// the response header has arrived, only the total timeout applies now
+	atomic.CompareAndSwapInt32(&firstByte, 0, 2)
+
+	var done DoneFunc
+	if newDone != nil {
+		done = newDone()
+	}
+
+	data, err = u.read(resp, done)
+	if err != nil {
+		return "", u.timeout(ctx, err, atomic.LoadInt32(&firstByte) == 1)
+	}
+
+	if err := u.classify(resp, data); err != nil {
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+			limiter.Backoff(err.(*UpstreamError).RetryAfter)
+		}
+		return "", err
+	}
+
+	limiter.Reset()
+
+	return data, nil
+}
+
+func (u *Upstream) observe(proxy *Proxy, err error) {
+	failed := err != nil && proxyFailure(err)
+	if proxy.Observe(failed, u.Proxies.Threshold, u.Proxies.Cooldown) {
+		IncMetricsCounter(&MetricsUpstreamCounter, MetricsUpstreamKey{u.Name, "proxy_eject"})
+		glog.Warningf("%s: eject proxy %s for %s after %+v", u.Name, proxy.Name, u.Proxies.Cooldown, err)
+	}
+}
+
+func (u *Upstream) read(resp *http.Response, done DoneFunc) (string, error) {
+	body := &io.LimitedReader{R: resp.Body, N: u.MaxBodySize + 1}
+	if u.MaxBodySize <= 0 {
+		body.N = math.MaxInt64
+	}
+
+	r := NewHTMLReader(body, resp.Header.Get("Content-Type"), u.Charset)
+
+	var b strings.Builder
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		b.Write(buf[:n])
+
+		if body.N <= 0 {
+			IncMetricsCounter(&MetricsUpstreamCounter, MetricsUpstreamKey{u.Name, "oversized"})
+			return "", &UpstreamError{
+				Upstream:   u.Name,
+				Kind:       UpstreamOversized,
+				StatusCode: resp.StatusCode,
+				Detail:     fmt.Sprintf("body larger than %d bytes", u.MaxBodySize),
+			}
+		}
+
+		switch {
+		case err == io.EOF:
+			return b.String(), nil
+		case err != nil:
+			return "", err
+		case n > 0 && done != nil && done(b.String()):
+			return b.String(), nil
+		}
+	}
+}
+
+// A DoneFunc reports whether the page read so far has everything needed. It
+// is called with the growing data after every chunk of one response, so it
+// may keep state between the calls.
+type DoneFunc func(data string) bool
+
+// matchOverlap is how far back a CompleteMatcher rescans the data it has seen,
+// a longer match straddling two chunks is only found in the whole page.
+const matchOverlap = 64 * 1024
+
+// CompleteMatcher finds the matches of Regex in a page read in chunks. Every
+// call scans only the data after the last match, or the tail of what was seen
+// before, so that a long page is not rescanned for each chunk.
+type CompleteMatcher struct {
+	Regex *regexp.Regexp
+
+	offset int
+}
+
+// Next returns the submatch indexes in data of the next match that ends
+// before the end of data, so that reading more of the page cannot change it.
+func (m *CompleteMatcher) Next(data string) []int {
+	loc := m.Regex.FindStringSubmatchIndex(data[m.offset:])
+	if loc == nil || m.offset+loc[1] >= len(data) {
+		// rescan an incomplete match or the tail with the next chunk
+		start := len(data) - matchOverlap
+		if loc != nil && m.offset+loc[0] > start {
+			start = m.offset + loc[0]
+		}
+		if start > m.offset {
+			m.offset = start
+		}
+		return nil
+	}
+
+	for i := range loc {
+		if loc[i] >= 0 {
+			loc[i] += m.offset
+		}
+	}
+	m.offset = loc[1]
+
+	return loc
+}
+
+func (u *Upstream) classify(resp *http.Response, data string) error {
+	var kind string
+
+	switch code := resp.StatusCode; {
+	case code == http.StatusTooManyRequests:
+		kind = UpstreamRateLimited
+	case code == http.StatusForbidden:
+		kind = UpstreamBlocked
+	case code == http.StatusNotFound || code == http.StatusGone:
+		kind = UpstreamNotFound
+	case code >= 500:
+		kind = UpstreamServerError
+		if u.blocked(data) {
+			kind = UpstreamBlocked
+		}
+	case code >= 400:
+		kind = UpstreamClientError
+	case code >= 300:
+		// e.g. a redirect to a consent or captcha page
+		kind = UpstreamServerError
+		if u.blocked(resp.Header.Get("Location")) {
+			kind = UpstreamBlocked
+		}
+	case u.blocked(data):
+		kind = UpstreamBlocked
+	default:
+		return nil
+	}
+
+	return &UpstreamError{
+		Upstream:   u.Name,
+		Kind:       kind,
+		StatusCode: resp.StatusCode,
+		RetryAfter: ParseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+}
+
+// timeout classifies err as an *UpstreamError if a timeout expired.
+func (u *Upstream) timeout(ctx context.Context, err error, firstByte bool) error {
+	var detail string
+
+	switch {
+	case firstByte:
+		detail = fmt.Sprintf("no response header after %s", u.FirstByteTimeout)
+	case ctx.Err() == context.DeadlineExceeded:
+		detail = fmt.Sprintf("not finished after %s", u.Timeout)
+	default:
+		if e, ok := err.(net.Error); !ok || !e.Timeout() {
+			return err
+		}
+		detail = err.Error()
+	}
+
+	return &UpstreamError{
+		Upstream: u.Name,
+		Kind:     UpstreamTimeout,
+		Detail:   detail,
+	}
+}
+
+func (u *Upstream) limiter(host string) *RateLimiter {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	l, ok := u.limiters[host]
+	if !ok {
+		if u.limiters == nil {
+			u.limiters = make(map[string]*RateLimiter)
+		}
+		l = NewRateLimiter(u.Rate, u.Burst, u.MaxBackoff)
+		u.limiters[host] = l
+	}
+
+	return l
+}
+
+func (u *Upstream) blocked(s string) bool {
+	for _, regex := range u.BlockPatterns {
+		if regex.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	UpstreamRateLimited = "rate_limited"
+	UpstreamBlocked     = "blocked"
+	UpstreamServerError = "server_error"
+	UpstreamClientError = "client_error"
+	UpstreamNotFound    = "not_found"
+	UpstreamBusy        = "busy"
+	UpstreamTimeout     = "timeout"
+	UpstreamOversized   = "oversized"
+)
+
+type UpstreamError struct {
+	Upstream   string
+	Kind       string
+	StatusCode int
+	RetryAfter time.Duration
+	Detail     string
+}
+
+func (e *UpstreamError) Error() string {
+	s := fmt.Sprintf("upstream %s %s", e.Upstream, e.Kind)
+	if e.StatusCode != 0 {
+		s += fmt.Sprintf(" (HTTP %d)", e.StatusCode)
+	}
+	if e.Detail != "" {
+		s += ": " + e.Detail
+	}
+	return s
+}
+
+// Cacheable reports whether the failure is about the requested resource,
+// a rate limit or block page says nothing about it and must not be cached.
+func (e *UpstreamError) Cacheable() bool {
+	return e.Kind == UpstreamNotFound || e.Kind == UpstreamClientError
+}
+
+// HTTPStatus is the status returned to our clients.
+func (e *UpstreamError) HTTPStatus() int {
+	switch e.Kind {
+	case UpstreamRateLimited:
+		return fasthttp.StatusTooManyRequests
+	case UpstreamBlocked, UpstreamBusy:
+		return fasthttp.StatusServiceUnavailable
+	case UpstreamTimeout:
+		return fasthttp.StatusGatewayTimeout
+	case UpstreamNotFound:
+		return fasthttp.StatusNoContent
+	default:
+		return fasthttp.StatusBadGateway
+	}
+}
+
+// Cacheable reports whether err may be negatively cached.
+func Cacheable(err error) bool {
+	c, ok := err.(interface {
+		Cacheable() bool
+	})
+	return !ok || c.Cacheable()
+}
+
+// SetErrorStatus sets the http status and Retry-After of a classified upstream
+// failure and returns the status for the response body, 204 for other errors.
+func SetErrorStatus(ctx *fasthttp.RequestCtx, err error) int {
+	s, ok := err.(interface {
+		HTTPStatus() int
+	})
+	if !ok || s.HTTPStatus() == fasthttp.StatusNoContent {
+		return fasthttp.StatusNoContent
+	}
+
+	if e, ok := err.(*UpstreamError); ok && e.RetryAfter > 0 {
+		ctx.Response.Header.Set("Retry-After", strconv.Itoa(int(math.Ceil(e.RetryAfter.Seconds()))))
+	}
+
+	ctx.SetStatusCode(s.HTTPStatus())
+	return s.HTTPStatus()
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/golibs/lrucache"
+	"golang.org/x/sync/singleflight"
+)
+
+const concurrentLookups = 50
+
+// newSlowServer serves body after a delay, so that concurrent identical
+// lookups overlap, and counts the requests.
+func newSlowServer(body string, hits *int64) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(hits, 1)
+		time.Sleep(50 * time.Millisecond)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		// write in chunks to catch readers sharing one body
+		for i := 0; i < len(body); i += 1024 {
+			end := i + 1024
+			if end > len(body) {
+				end = len(body)
+			}
+			w.Write([]byte(body[i:end]))
+			w.(http.Flusher).Flush()
+		}
+	}))
+}
+
+func TestConcurrentGoogleplaySearch(t *testing.T) {
+	const count = 500
+
+	var b strings.Builder
+	for i := 0; i < count; i++ {
+		fmt.Fprintf(&b, `<a class="title" href="/store/apps/details?id=com.example.app%d" title="Example App %d">`+"\n", i, i)
+	}
+
+	var hits int64
+	srv := newSlowServer(b.String(), &hits)
+	defer srv.Close()
+
+	h := &LookupHandler{
+		SearchURL:    srv.URL + "/store/search?q=%s",
+		SearchRegex:  regexp.MustCompile(`<a class="title" href="/store/apps/details\?id=(\S+)" title="([^"]+)"`),
+		SearchTTL:    time.Minute,
+		SearchCache:  lrucache.NewLRUCache(100),
+		Singleflight: &singleflight.Group{},
+		Upstream:     &Upstream{Name: "googleplay", Transport: &http.Transport{}},
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, concurrentLookups)
+	for i := 0; i < concurrentLookups; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			items, err := h.googleplaySearch("example", "US", "en")
+			switch {
+			case err != nil:
+				errs <- err
+			case len(items) != count:
+				errs <- fmt.Errorf("got %d items, want %d", len(items), count)
+			case items[count-1].PackageName != fmt.Sprintf("com.example.app%d", count-1):
+				errs <- fmt.Errorf("got last item %+v", items[count-1])
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if n := atomic.LoadInt64(&hits); n != 1 {
+		t.Errorf("got %d upstream requests, want 1", n)
+	}
+}
+
+func TestConcurrentGeoProviderLookup(t *testing.T) {
+	// pad the page so that the match is at the end of a long body
+	body := strings.Repeat("<!-- padding -->\n", 4096) + "<code>1.2.3.4</code> 来自：中国北京市 联通"
+
+	var hits int64
+	srv := newSlowServer(body, &hits)
+	defer srv.Close()
+
+	p, err := NewGeoProvider(IpinfoProviderConfig{
+		Name:  "test",
+		Url:   srv.URL + "/?ip=%s",
+		Regex: `来自：(\S+) (\S+)`,
+	}, nil, nil, &http.Transport{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	items := make([]*IpinfoItem, concurrentLookups)
+	errs := make([]error, concurrentLookups)
+	for i := 0; i < concurrentLookups; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			items[i], errs[i] = p.Lookup("1.2.3.4")
+		}(i)
+	}
+	wg.Wait()
+
+	for i, item := range items {
+		if errs[i] != nil {
+			t.Errorf("lookup %d error: %+v", i, errs[i])
+			continue
+		}
+		if item.Location != "中国北京市" || item.ISP != "联通" {
+			t.Errorf("lookup %d got %+v", i, item)
+		}
+		if i > 0 && item == items[0] {
+			t.Errorf("lookup %d shares its item with lookup 0", i)
+		}
+	}
+
+	if n := atomic.LoadInt64(&hits); n != 1 {
+		t.Errorf("got %d upstream requests, want 1", n)
+	}
+}
+
+func TestCompleteMatcher(t *testing.T) {
+	regex := regexp.MustCompile(`<b>(\w+)</b>`)
+
+	var page strings.Builder
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&page, "<p>%s</p><b>word%d</b>", strings.Repeat("-", i%300), i)
+	}
+	data := page.String()
+
+	// feed the page in growing prefixes as the upstream reader does
+	var words []string
+	m := &CompleteMatcher{Regex: regex}
+	for n := 7; ; n += 7 {
+		if n > len(data) {
+			n = len(data)
+		}
+		for {
+			loc := m.Next(data[:n])
+			if loc == nil {
+				break
+			}
+			words = append(words, data[loc[2]:loc[3]])
+		}
+		if n == len(data) {
+			break
+		}
+	}
+
+	// the last match ends with the page, it is not complete
+	if len(words) != 999 {
+		t.Fatalf("got %d matches, want 999", len(words))
+	}
+	for i, word := range words {
+		if want := fmt.Sprintf("word%d", i); word != want {
+			t.Fatalf("match %d is %s, want %s", i, word, want)
+		}
+	}
+}
+
+// newStatusServer answers the requests in turn with statuses, the last one
+// repeated, and counts them.
+func newStatusServer(hits *int64, statuses ...int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(atomic.AddInt64(hits, 1))
+		if n > len(statuses) {
+			n = len(statuses)
+		}
+		w.WriteHeader(statuses[n-1])
+		fmt.Fprintf(w, "response %d", n)
+	}))
+}
+
+func TestUpstreamRetry(t *testing.T) {
+	cases := []struct {
+		statuses []int
+		hits     int64
+		kind     string
+	}{
+		{[]int{500, 200}, 2, ""},
+		{[]int{502, 500, 200}, 3, ""},
+		{[]int{500}, 3, UpstreamServerError},
+		{[]int{503}, 1, UpstreamServerError},
+		{[]int{403, 200}, 1, UpstreamBlocked},
+		{[]int{404, 200}, 1, UpstreamNotFound},
+		{[]int{429, 200}, 1, UpstreamRateLimited},
+	}
+
+	for _, c := range cases {
+		var hits int64
+		srv := newStatusServer(&hits, c.statuses...)
+
+		u := &Upstream{
+			Name:         "test",
+			Retries:      2,
+			RetryBackoff: time.Millisecond,
+			Transport:    &http.Transport{},
+		}
+
+		_, err := u.Get(srv.URL, "", nil, nil)
+		srv.Close()
+
+		kind := ""
+		if err != nil {
+			e, ok := err.(*UpstreamError)
+			if !ok {
+				t.Errorf("%v: unexpected error %+v", c.statuses, err)
+				continue
+			}
+			kind = e.Kind
+		}
+
+		if kind != c.kind || hits != c.hits {
+			t.Errorf("%v: error %#v after %d requests, want %#v after %d", c.statuses, kind, hits, c.kind, c.hits)
+		}
+	}
+}
+
+func TestUpstreamBackoff(t *testing.T) {
+	u := &Upstream{RetryBackoff: 100 * time.Millisecond}
+
+	for attempt := 0; attempt < 5; attempt++ {
+		max := u.RetryBackoff << uint(attempt)
+		for i := 0; i < 1000; i++ {
+			if d := u.backoff(attempt); d < max/2 || d > max {
+				t.Fatalf("backoff(%d) = %s, want between %s and %s", attempt, d, max/2, max)
+			}
+		}
+	}
+
+	if d := (&Upstream{}).backoff(3); d != 0 {
+		t.Errorf("backoff without retry_backoff = %s, want 0", d)
+	}
+}
+
+func TestUpstreamHedge(t *testing.T) {
+	var hits int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&hits, 1) == 1 {
+			// the first request hangs until the hedged one has won
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			w.Write([]byte("slow"))
+			return
+		}
+		w.Write([]byte("fast"))
+	}))
+	defer srv.Close()
+
+	u := &Upstream{
+		Name:       "test",
+		HedgeDelay: 50 * time.Millisecond,
+		Transport:  &http.Transport{},
+	}
+
+	start := time.Now()
+	data, err := u.Get(srv.URL, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if data != "fast" {
+		t.Errorf("got %#v, want the hedged response", data)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("hedged request took %s", d)
+	}
+	if n := atomic.LoadInt64(&hits); n != 2 {
+		t.Errorf("%d requests, want 2", n)
+	}
+}
+
+func TestUpstreamHedgeBothFail(t *testing.T) {
+	var hits int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&hits, 1)
+		time.Sleep(100 * time.Millisecond)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	u := &Upstream{
+		Name:       "test",
+		HedgeDelay: 20 * time.Millisecond,
+		Transport:  &http.Transport{},
+	}
+
+	_, err := u.Get(srv.URL, "", nil, nil)
+	if e, ok := err.(*UpstreamError); !ok || e.Kind != UpstreamServerError {
+		t.Errorf("got error %+v, want a server error", err)
+	}
+	if n := atomic.LoadInt64(&hits); n != 2 {
+		t.Errorf("%d requests, want 2", n)
+	}
+}